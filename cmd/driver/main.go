@@ -8,15 +8,26 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	log "github.com/hashicorp/go-hclog"
 
 	"github.com/hashicorp/nomad/plugins"
+	"github.com/sylabs/nomad-driver-singularity/pkg/executor"
 	singularity "github.com/sylabs/nomad-driver-singularity/pkg/plugin"
-
-	useragent "github.com/sylabs/singularity/pkg/util/user-agent"
 )
 
 func main() {
+	// The driver binary doubles as the executor supervising containers
+	if len(os.Args) > 1 && os.Args[1] == executor.Command {
+		if err := executor.Run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "executor: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Serve the plugin
 	plugins.Serve(factory)
 }
@@ -25,8 +36,3 @@ func main() {
 func factory(log log.Logger) interface{} {
 	return singularity.NewSingularityDriver(log)
 }
-
-func init() {
-	// Initialize user agent strings
-	useragent.InitValue("singularity", "3.1.1")
-}
@@ -0,0 +1,124 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	// startTimeout is how long Launch waits for a new executor to accept
+	// connections
+	startTimeout = 10 * time.Second
+
+	// dialInterval is the interval between connection attempts to a
+	// starting executor
+	dialInterval = 50 * time.Millisecond
+)
+
+// Client is a connection to an executor process
+type Client struct {
+	rpc *rpc.Client
+}
+
+// Launch spawns a new executor process from the running binary and returns
+// a client connected to it. The executor is started in its own session so
+// it is not affected by the driver exiting.
+func Launch(cfg *Config) (*Client, error) {
+	bin, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find driver binary: %v", err)
+	}
+
+	c, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode executor configuration: %v", err)
+	}
+
+	cmd := exec.Command(bin, Command, string(c))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start executor: %v", err)
+	}
+
+	// reap the executor whenever it exits while the driver is running
+	exitCh := make(chan error, 1)
+	go func() {
+		exitCh <- cmd.Wait()
+	}()
+
+	deadline := time.After(startTimeout)
+	for {
+		client, err := Reattach(cfg.SocketPath)
+		if err == nil {
+			return client, nil
+		}
+
+		select {
+		case err := <-exitCh:
+			return nil, fmt.Errorf("executor exited before accepting connections: %v", err)
+		case <-deadline:
+			cmd.Process.Kill()
+			return nil, fmt.Errorf("timeout waiting for executor: %v", err)
+		case <-time.After(dialInterval):
+		}
+	}
+}
+
+// Reattach connects to a running executor listening on socketPath
+func Reattach(socketPath string) (*Client, error) {
+	c, err := rpc.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{rpc: c}, nil
+}
+
+// Launch starts the process described by req and returns its pid
+func (c *Client) Launch(req *LaunchRequest) (int, error) {
+	var resp LaunchResponse
+	if err := c.rpc.Call(rpcName+".Launch", req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Pid, nil
+}
+
+// Wait blocks until the process exits and returns its exit state
+func (c *Client) Wait() (*ProcessState, error) {
+	var state ProcessState
+	if err := c.rpc.Call(rpcName+".Wait", struct{}{}, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Signal delivers sig to the process
+func (c *Client) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+	return c.rpc.Call(rpcName+".Signal", int(s), &struct{}{})
+}
+
+// Destroy kills the process if it is still running, terminates the executor
+// and closes the client
+func (c *Client) Destroy() error {
+	err := c.rpc.Call(rpcName+".Destroy", struct{}{}, &struct{}{})
+	c.rpc.Close()
+	return err
+}
+
+// Close closes the connection to the executor, leaving it running
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
@@ -0,0 +1,393 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package executor implements a small supervisor process owning the
+// singularity process of a task, so that tasks outlive the driver plugin.
+// The driver talks to it over a unix socket using net/rpc.
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/lib/fifo"
+)
+
+const (
+	// Command is the sub-command of the driver binary running an executor
+	Command = "executor"
+
+	// rpcName is the name the executor is registered with on the rpc server
+	rpcName = "Executor"
+
+	// defaultFailedCode is the exit code reported when the exit status of
+	// the process could not be determined
+	defaultFailedCode = 255
+
+	// shutdownGracePeriod is how long the executor waits for clients to
+	// hang up after being destroyed
+	shutdownGracePeriod = time.Second
+
+	// destroyKillTimeout is how long Destroy waits for a killed process
+	destroyKillTimeout = 5 * time.Second
+
+	// startShell runs startShim, which blocks until the executor writes to
+	// the pipe passed as fd 3 then execs the command given as arguments.
+	// A process started by the executor exits if the executor dies before
+	// releasing it.
+	startShell = "/bin/sh"
+	startShim  = `read -r _ <&3 || exit 255; exec 3<&-; exec "$0" "$@"`
+)
+
+// Config is the configuration passed on the command line to an executor
+type Config struct {
+	// SocketPath is the unix socket the executor listens on
+	SocketPath string
+
+	// LogFile is the file the executor writes its own logs to
+	LogFile string
+
+	// LogLevel is the level of the executor logger
+	LogLevel string
+}
+
+// LaunchRequest describes the process the executor supervises
+type LaunchRequest struct {
+	Cmd        string
+	Args       []string
+	Env        []string
+	Dir        string
+	StdoutPath string
+	StderrPath string
+
+	// Cgroups lists the cgroup directories the process is placed in before
+	// it runs the command, so that it and its children are accounted in
+	// them while the executor is not
+	Cgroups []string
+}
+
+// LaunchResponse is returned once the process is started
+type LaunchResponse struct {
+	Pid int
+}
+
+// ProcessState holds the exit state of the supervised process
+type ProcessState struct {
+	Pid      int
+	ExitCode int
+	Signal   int
+	Time     time.Time
+}
+
+// Executor supervises a single process on behalf of the driver. Its exported
+// methods are served over net/rpc.
+type Executor struct {
+	logger hclog.Logger
+
+	// lock syncs access to all fields below
+	lock   sync.Mutex
+	cmd    *exec.Cmd
+	stdout io.WriteCloser
+	stderr io.WriteCloser
+	state  *ProcessState
+
+	// doneCh is closed once the process has exited
+	doneCh chan struct{}
+
+	// shutdownCh is closed when the executor is destroyed
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+func newExecutor(logger hclog.Logger) *Executor {
+	return &Executor{
+		logger:     logger,
+		doneCh:     make(chan struct{}),
+		shutdownCh: make(chan struct{}),
+	}
+}
+
+// Launch starts the process described by req
+func (e *Executor) Launch(req *LaunchRequest, resp *LaunchResponse) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.cmd != nil {
+		return fmt.Errorf("process already launched")
+	}
+
+	cmd := exec.Command(req.Cmd, req.Args...)
+	var release *os.File
+	if len(req.Cgroups) != 0 {
+		// the process waits for the executor to place it in the cgroups
+		// before running the command, which keeps its pid
+		r, w, err := os.Pipe()
+		if err != nil {
+			return fmt.Errorf("failed to create start pipe: %v", err)
+		}
+		defer r.Close()
+		defer w.Close()
+		release = w
+
+		cmd = exec.Command(startShell, append([]string{"-c", startShim, req.Cmd}, req.Args...)...)
+		cmd.ExtraFiles = []*os.File{r}
+	}
+	cmd.Env = req.Env
+	cmd.Dir = req.Dir
+	// the process leads its own group so the driver can signal the
+	// whole container without reaching the executor
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if req.StdoutPath != "" {
+		f, err := fifo.OpenWriter(req.StdoutPath)
+		if err != nil {
+			return fmt.Errorf("failed to create stdout: %v", err)
+		}
+		e.stdout = f
+		cmd.Stdout = f
+	}
+	if req.StderrPath != "" {
+		f, err := fifo.OpenWriter(req.StderrPath)
+		if err != nil {
+			e.closeOutputs()
+			return fmt.Errorf("failed to create stderr: %v", err)
+		}
+		e.stderr = f
+		cmd.Stderr = f
+	}
+
+	if err := cmd.Start(); err != nil {
+		e.closeOutputs()
+		return fmt.Errorf("failed to start process: %v", err)
+	}
+
+	if release != nil {
+		if err := joinCgroups(cmd.Process.Pid, req.Cgroups); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			e.closeOutputs()
+			return err
+		}
+		if _, err := release.Write([]byte("\n")); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			e.closeOutputs()
+			return fmt.Errorf("failed to release process: %v", err)
+		}
+	}
+	e.logger.Info("launched process", "pid", cmd.Process.Pid, "cmd", req.Cmd)
+
+	e.cmd = cmd
+	go e.wait()
+
+	resp.Pid = cmd.Process.Pid
+	return nil
+}
+
+// joinCgroups places the process pid in the cgroup directories dirs
+func joinCgroups(pid int, dirs []string) error {
+	for _, dir := range dirs {
+		data := []byte(strconv.Itoa(pid))
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), data, 0644); err != nil {
+			return fmt.Errorf("failed to join cgroup %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// wait reaps the process and records its exit state
+func (e *Executor) wait() {
+	err := e.cmd.Wait()
+
+	state := &ProcessState{Pid: e.cmd.Process.Pid, Time: time.Now()}
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			ws := exitError.Sys().(syscall.WaitStatus)
+			state.ExitCode = ws.ExitStatus()
+			if ws.Signaled() {
+				state.Signal = int(ws.Signal())
+				state.ExitCode = 128 + state.Signal
+			}
+		} else {
+			e.logger.Error("could not get exit code for process", "error", err)
+			state.ExitCode = defaultFailedCode
+		}
+	}
+	e.logger.Info("process exited", "pid", state.Pid, "exit_code", state.ExitCode, "signal", state.Signal)
+
+	e.lock.Lock()
+	e.state = state
+	e.closeOutputs()
+	e.lock.Unlock()
+
+	close(e.doneCh)
+}
+
+// closeOutputs closes the stdout and stderr fifos, e.lock must be held
+func (e *Executor) closeOutputs() {
+	if e.stdout != nil {
+		e.stdout.Close()
+		e.stdout = nil
+	}
+	if e.stderr != nil {
+		e.stderr.Close()
+		e.stderr = nil
+	}
+}
+
+// Wait blocks until the process exits and returns its exit state
+func (e *Executor) Wait(_ struct{}, resp *ProcessState) error {
+	e.lock.Lock()
+	launched := e.cmd != nil
+	e.lock.Unlock()
+	if !launched {
+		return fmt.Errorf("process not launched")
+	}
+
+	<-e.doneCh
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	*resp = *e.state
+	return nil
+}
+
+// Signal delivers sig to the process
+func (e *Executor) Signal(sig int, _ *struct{}) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.cmd == nil {
+		return fmt.Errorf("process not launched")
+	}
+	if e.state != nil {
+		return fmt.Errorf("process has already exited")
+	}
+	return e.cmd.Process.Signal(syscall.Signal(sig))
+}
+
+// Destroy kills the process if it is still running and terminates the
+// executor
+func (e *Executor) Destroy(_ struct{}, _ *struct{}) error {
+	e.lock.Lock()
+	cmd := e.cmd
+	running := cmd != nil && e.state == nil
+	e.lock.Unlock()
+
+	if running {
+		// kill the whole process group, the process may have left
+		// children behind
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			e.logger.Warn("failed to kill process group", "error", err)
+			if err := cmd.Process.Kill(); err != nil {
+				e.logger.Warn("failed to kill process", "error", err)
+			}
+		}
+		select {
+		case <-e.doneCh:
+		case <-time.After(destroyKillTimeout):
+			e.logger.Warn("timeout waiting for killed process to exit")
+		}
+	}
+
+	// the outputs are closed once the process is reaped, make sure they
+	// are released even if it could not be
+	e.lock.Lock()
+	e.closeOutputs()
+	e.lock.Unlock()
+
+	e.shutdownOnce.Do(func() { close(e.shutdownCh) })
+	return nil
+}
+
+// Run is the entry point of an executor process. args holds the json encoded
+// Config. It returns once the executor has been destroyed by the driver.
+func Run(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a single configuration argument, got %d", len(args))
+	}
+
+	var cfg Config
+	if err := json.Unmarshal([]byte(args[0]), &cfg); err != nil {
+		return fmt.Errorf("failed to decode executor configuration: %v", err)
+	}
+
+	var out io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		f, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open executor log file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:   "singularity.executor",
+		Level:  hclog.LevelFromString(cfg.LogLevel),
+		Output: out,
+	})
+
+	l, err := net.Listen("unix", cfg.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", cfg.SocketPath, err)
+	}
+
+	e := newExecutor(logger)
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(rpcName, e); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to register executor: %v", err)
+	}
+
+	var conns sync.WaitGroup
+	acceptDone := make(chan struct{})
+	go func() {
+		defer close(acceptDone)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				srv.ServeConn(conn)
+			}()
+		}
+	}()
+
+	logger.Info("executor started", "socket", cfg.SocketPath)
+	<-e.shutdownCh
+
+	// stop accepting connections, then give clients a chance to read the
+	// reply to the Destroy call before exiting
+	l.Close()
+	<-acceptDone
+
+	connsDone := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(connsDone)
+	}()
+	select {
+	case <-connsDone:
+	case <-time.After(shutdownGracePeriod):
+	}
+
+	logger.Info("executor stopped")
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startExecutor runs an executor in the test process and connects to it
+func startExecutor(t *testing.T, dir string) (*Client, <-chan error) {
+	cfg, err := json.Marshal(&Config{
+		SocketPath: filepath.Join(dir, "executor.sock"),
+		LogFile:    filepath.Join(dir, "executor.out"),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Run([]string{string(cfg)})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := Reattach(filepath.Join(dir, "executor.sock"))
+		if err == nil {
+			return c, errCh
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed to connect to executor: %v", err)
+		}
+		time.Sleep(dialInterval)
+	}
+}
+
+func TestExecutor_ExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, errCh := startExecutor(t, dir)
+
+	pid, err := c.Launch(&LaunchRequest{Cmd: "/bin/sh", Args: []string{"-c", "exit 3"}})
+	if err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+
+	ps, err := c.Wait()
+	if err != nil {
+		t.Fatalf("failed to wait on process: %v", err)
+	}
+	if ps.Pid != pid || ps.ExitCode != 3 || ps.Signal != 0 {
+		t.Errorf("unexpected process state: %+v", ps)
+	}
+
+	if err := c.Destroy(); err != nil {
+		t.Fatalf("failed to destroy executor: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("executor returned an error: %v", err)
+	}
+}
+
+func TestExecutor_Signal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, errCh := startExecutor(t, dir)
+
+	if _, err := c.Launch(&LaunchRequest{Cmd: "/bin/sleep", Args: []string{"60"}}); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := c.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to signal process: %v", err)
+	}
+
+	ps, err := c.Wait()
+	if err != nil {
+		t.Fatalf("failed to wait on process: %v", err)
+	}
+	if ps.Signal != int(syscall.SIGTERM) || ps.ExitCode != 128+int(syscall.SIGTERM) {
+		t.Errorf("unexpected process state: %+v", ps)
+	}
+	if err := c.Signal(syscall.SIGTERM); err == nil {
+		t.Errorf("expected an error signaling an exited process")
+	}
+
+	if err := c.Destroy(); err != nil {
+		t.Fatalf("failed to destroy executor: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("executor returned an error: %v", err)
+	}
+}
+
+// processExited returns true once pid has exited, orphans may be left as
+// zombies until init reaps them
+func processExited(pid int) bool {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestExecutor_DestroyKillsGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, errCh := startExecutor(t, dir)
+
+	childFile := filepath.Join(dir, "child")
+	script := "sleep 60 & echo $! > " + childFile + "; wait"
+	if _, err := c.Launch(&LaunchRequest{Cmd: "/bin/sh", Args: []string{"-c", script}}); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+
+	var child int
+	for i := 0; i < 100 && child == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		data, _ := ioutil.ReadFile(childFile)
+		child, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if child == 0 {
+		t.Fatalf("child process did not start")
+	}
+
+	if err := c.Destroy(); err != nil {
+		t.Fatalf("failed to destroy executor: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("executor returned an error: %v", err)
+	}
+
+	for i := 0; i < 50 && !processExited(child); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !processExited(child) {
+		syscall.Kill(child, syscall.SIGKILL)
+		t.Errorf("child process %d survived the executor", child)
+	}
+}
+
+func TestExecutor_CgroupsChildOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a plain directory stands for the cgroup, recording the pid written
+	// to its cgroup.procs
+	cgroup := filepath.Join(dir, "cgroup")
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(dir, "pid")
+
+	c, errCh := startExecutor(t, dir)
+
+	pid, err := c.Launch(&LaunchRequest{
+		Cmd:     "/bin/sh",
+		Args:    []string{"-c", "echo $$ > " + pidFile + "; exit 4"},
+		Cgroups: []string{cgroup},
+	})
+	if err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+
+	ps, err := c.Wait()
+	if err != nil {
+		t.Fatalf("failed to wait on process: %v", err)
+	}
+	if ps.Pid != pid || ps.ExitCode != 4 {
+		t.Errorf("unexpected process state: %+v", ps)
+	}
+
+	procs, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		t.Fatalf("failed to read cgroup.procs: %v", err)
+	}
+	if string(procs) != strconv.Itoa(pid) || string(procs) == strconv.Itoa(os.Getpid()) {
+		t.Errorf("expected only the process %d in the cgroup, got %q", pid, procs)
+	}
+	// the command runs in the process placed in the cgroup
+	if data, _ := ioutil.ReadFile(pidFile); strings.TrimSpace(string(data)) != strconv.Itoa(pid) {
+		t.Errorf("expected the command to run as pid %d, got %q", pid, data)
+	}
+
+	if err := c.Destroy(); err != nil {
+		t.Fatalf("failed to destroy executor: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("executor returned an error: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// dockerHubRegistry is the registry of docker images without a host
+	dockerHubRegistry = "docker.io"
+
+	// credentialHelperPrefix prefixes the name of the binaries implementing
+	// the docker credential helper protocol
+	credentialHelperPrefix = "docker-credential-"
+)
+
+// TaskAuth holds the credentials a task pulls its image with
+type TaskAuth struct {
+	// Username and Password authenticate against docker and oras registries
+	Username string `codec:"username"`
+	Password string `codec:"password"`
+
+	// Token is the access token of a library
+	Token string `codec:"token"`
+}
+
+// String hides the credentials when the task config is logged
+func (a TaskAuth) String() string {
+	if a.empty() {
+		return "{}"
+	}
+	return fmt.Sprintf("{Username:%s Password:<redacted> Token:<redacted>}", a.Username)
+}
+
+func (a TaskAuth) empty() bool {
+	return a.Username == "" && a.Password == "" && a.Token == ""
+}
+
+// registryAuth holds the credentials of a pull
+type registryAuth struct {
+	username string
+	password string
+	token    string
+}
+
+// env returns the environment passing the credentials to singularity pull,
+// which keeps them out of its command line
+func (a *registryAuth) env() []string {
+	if a == nil {
+		return nil
+	}
+	var env []string
+	if a.username != "" || a.password != "" {
+		env = append(env,
+			"SINGULARITY_DOCKER_USERNAME="+a.username,
+			"SINGULARITY_DOCKER_PASSWORD="+a.password,
+		)
+	}
+	if a.token != "" {
+		env = append(env, "SYLABS_TOKEN="+a.token)
+	}
+	return env
+}
+
+// identity returns a short hash identifying the credentials pulling the image
+// uri, empty for anonymous pulls. The identity names cached images, so that
+// only tasks with the same credentials run them, and secrets are only hashed
+// into it.
+func (a *registryAuth) identity(uri string) string {
+	if a == nil {
+		return ""
+	}
+	registry := imageScheme(uri)
+	switch registry {
+	case "docker", "oras":
+		registry = imageRegistry(uri)
+	}
+	password := sha256.Sum256([]byte(a.password))
+	token := sha256.Sum256([]byte(a.token))
+	sum := sha256.Sum256([]byte(registry + "\x00" + a.username + "\x00" +
+		hex.EncodeToString(password[:]) + "\x00" + hex.EncodeToString(token[:])))
+	return hex.EncodeToString(sum[:8])
+}
+
+// imageRegistry returns the registry host of a docker or oras image uri
+func imageRegistry(uri string) string {
+	ref := strings.TrimPrefix(uri, imageScheme(uri)+"://")
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (imageScheme(uri) == "oras" ||
+		strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return normalizeRegistry(parts[0])
+	}
+	return dockerHubRegistry
+}
+
+// normalizeRegistry strips the scheme and path of a registry address, as found
+// in docker configuration files, and maps the docker hub aliases to a single
+// name
+func normalizeRegistry(addr string) string {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		addr = addr[i+3:]
+	}
+	addr = strings.SplitN(addr, "/", 2)[0]
+	switch addr {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHubRegistry
+	}
+	return addr
+}
+
+// pullAuth returns the credentials to pull the image uri with. The
+// credentials of the task take precedence over the ones found in the auth
+// config file and credential helper of the plugin, which only apply to
+// registries.
+func (d *Driver) pullAuth(uri string, auth TaskAuth) (*registryAuth, error) {
+	if !auth.empty() {
+		return &registryAuth{
+			username: auth.Username,
+			password: auth.Password,
+			token:    auth.Token,
+		}, nil
+	}
+
+	switch imageScheme(uri) {
+	case "docker", "oras":
+	default:
+		return nil, nil
+	}
+	registry := imageRegistry(uri)
+
+	if d.config.AuthConfig != "" {
+		a, helper, err := authFromConfigFile(d.config.AuthConfig, registry)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			return a, nil
+		}
+		if helper != "" {
+			return authFromHelper(helper, registry)
+		}
+	}
+	if d.config.AuthHelper != "" {
+		return authFromHelper(d.config.AuthHelper, registry)
+	}
+	return nil, nil
+}
+
+// dockerConfigFile is the subset of a docker config.json used to find the
+// credentials of a registry
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// authFromConfigFile returns the credentials of registry stored in the docker
+// config file at path, or else the credential helper it configures for it
+func authFromConfigFile(path, registry string) (*registryAuth, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read auth config %s: %v", path, err)
+	}
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, "", fmt.Errorf("failed to parse auth config %s: %v", path, err)
+	}
+
+	for addr, entry := range cfg.Auths {
+		if normalizeRegistry(addr) != registry {
+			continue
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to decode credentials of %s in %s: %v", registry, path, err)
+			}
+			userpass := strings.SplitN(string(decoded), ":", 2)
+			if len(userpass) != 2 {
+				return nil, "", fmt.Errorf("invalid credentials of %s in %s", registry, path)
+			}
+			return &registryAuth{username: userpass[0], password: userpass[1]}, "", nil
+		}
+		if entry.Username != "" {
+			return &registryAuth{username: entry.Username, password: entry.Password}, "", nil
+		}
+	}
+
+	for addr, helper := range cfg.CredHelpers {
+		if normalizeRegistry(addr) == registry {
+			return nil, helper, nil
+		}
+	}
+	return nil, cfg.CredsStore, nil
+}
+
+// authFromHelper returns the credentials of registry given by the docker
+// credential helper named helper
+func authFromHelper(helper, registry string) (*registryAuth, error) {
+	bin, err := exec.LookPath(credentialHelperPrefix + helper)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find credential helper %s: %v", helper, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, "get")
+	cmd.Stdin = strings.NewReader(registry)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// helpers report missing credentials on stdout
+		msg := strings.TrimSpace(stdout.String() + " " + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %v: %s", helper, err, msg)
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse the output of credential helper %s: %v", helper, err)
+	}
+	return &registryAuth{username: creds.Username, password: creds.Secret}, nil
+}
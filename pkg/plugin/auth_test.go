@@ -0,0 +1,175 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestImageRegistry(t *testing.T) {
+	for uri, want := range map[string]string{
+		"docker://alpine:3.9":                        "docker.io",
+		"docker://library/alpine:3.9":                "docker.io",
+		"docker://registry.example.com/team/app:1.0": "registry.example.com",
+		"docker://localhost/app":                     "localhost",
+		"docker://registry.example.com:5000/app:1.0": "registry.example.com:5000",
+		"oras://registry/images/app:1.0":             "registry",
+	} {
+		if got := imageRegistry(uri); got != want {
+			t.Errorf("imageRegistry(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestTaskAuth_String(t *testing.T) {
+	auth := TaskAuth{Username: "user", Password: "s3cr3t", Token: "t0k3n"}
+	for _, s := range []string{
+		auth.String(),
+		fmt.Sprintf("%+v", TaskConfig{Image: "docker://alpine", Auth: auth}),
+	} {
+		if strings.Contains(s, "s3cr3t") || strings.Contains(s, "t0k3n") {
+			t.Errorf("credentials leaked in %q", s)
+		}
+	}
+}
+
+func TestDriver_PullAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the helper serves the credentials of registry.example.com only
+	helper := `#!/bin/sh
+read registry
+if [ "$registry" != "registry.example.com" ]; then
+	echo "credentials not found in native keychain"
+	exit 1
+fi
+echo '{"ServerURL":"registry.example.com","Username":"helper","Secret":"helper-secret"}'
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := `{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOmh1Yi1zZWNyZXQ="},
+		"quay.io": {"username": "quay", "password": "quay-secret"}
+	},
+	"credHelpers": {"registry.example.com": "test"}
+}`
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.AuthConfig = configPath
+
+	for _, tc := range []struct {
+		uri  string
+		auth TaskAuth
+		want *registryAuth
+	}{
+		{"docker://alpine", TaskAuth{}, &registryAuth{username: "hub", password: "hub-secret"}},
+		{"docker://quay.io/app", TaskAuth{}, &registryAuth{username: "quay", password: "quay-secret"}},
+		{"docker://registry.example.com/app", TaskAuth{}, &registryAuth{username: "helper", password: "helper-secret"}},
+		{"oras://other.example.com/app", TaskAuth{}, nil},
+		{"library://sylabsed/examples/lolcow", TaskAuth{}, nil},
+		{"library://private/app", TaskAuth{Token: "t0k3n"}, &registryAuth{token: "t0k3n"}},
+		{"docker://alpine", TaskAuth{Username: "task", Password: "task-secret"}, &registryAuth{username: "task", password: "task-secret"}},
+	} {
+		got, err := d.pullAuth(tc.uri, tc.auth)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.uri, err)
+			continue
+		}
+		if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+			t.Errorf("%s: expected credentials %+v, got %+v", tc.uri, tc.want, got)
+		}
+	}
+
+	// the plugin helper applies when the config file doesn't match
+	d.config.AuthConfig = ""
+	d.config.AuthHelper = "test"
+	if got, err := d.pullAuth("docker://registry.example.com/app", TaskAuth{}); err != nil || got == nil || got.username != "helper" {
+		t.Errorf("unexpected helper credentials %+v: %v", got, err)
+	}
+}
+
+func TestDriver_PullImageAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `#!/bin/sh
+echo "$@" > ` + filepath.Join(dir, "argv") + `
+env > ` + filepath.Join(dir, "env") + `
+echo SIF > "$2"
+`
+	bin := filepath.Join(dir, "singularity")
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.SingularityCache = filepath.Join(dir, "cache")
+
+	uri := "docker://registry.example.com/app"
+	auth := &registryAuth{username: "user", password: "s3cr3t"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.pullImage(ctx, bin, uri, d.imagePath(uri, auth), auth); err != nil {
+		t.Fatalf("failed to pull image: %v", err)
+	}
+
+	argv, _ := ioutil.ReadFile(filepath.Join(dir, "argv"))
+	if bytes.Contains(argv, []byte("s3cr3t")) {
+		t.Errorf("credentials leaked in argv %q", argv)
+	}
+	env, _ := ioutil.ReadFile(filepath.Join(dir, "env"))
+	for _, want := range []string{"SINGULARITY_DOCKER_USERNAME=user", "SINGULARITY_DOCKER_PASSWORD=s3cr3t"} {
+		if !bytes.Contains(env, []byte(want)) {
+			t.Errorf("expected %s in the pull environment", want)
+		}
+	}
+}
+
+func TestTaskState_NoCredentials(t *testing.T) {
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc"}
+	taskCfg := TaskConfig{
+		Image: "docker://registry.example.com/app",
+		Auth:  TaskAuth{Username: "user", Password: "s3cr3t", Token: "t0k3n"},
+	}
+	if err := cfg.EncodeConcreteDriverConfig(&taskCfg); err != nil {
+		t.Fatal(err)
+	}
+
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	if err := handle.SetDriverState(&TaskState{TaskConfig: cfg, ContainerName: taskCfg.Image}); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(handle.DriverState, []byte("s3cr3t")) || bytes.Contains(handle.DriverState, []byte("t0k3n")) {
+		t.Errorf("credentials leaked in the task state")
+	}
+}
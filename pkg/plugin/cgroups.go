@@ -0,0 +1,267 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// cgroupParent is the cgroup under which task cgroups are created
+	cgroupParent = "nomad-singularity"
+
+	// cgroupV1 and cgroupV2 identify the legacy hierarchies, with one
+	// hierarchy per controller, and the unified hierarchy
+	cgroupV1 = 1
+	cgroupV2 = 2
+
+	// cgroupRemoveTimeout is how long destroy retries to remove a cgroup
+	// still holding exiting processes
+	cgroupRemoveTimeout = 5 * time.Second
+
+	// cgroupRemoveInterval is the delay between two removal attempts
+	cgroupRemoveInterval = 100 * time.Millisecond
+
+	// cgroupUnified is the key of the single cgroup v2 directory in
+	// taskCgroup.Paths
+	cgroupUnified = "unified"
+)
+
+// cgroupLimits holds the resources enforced in a task cgroup. Nomad reserves
+// exactly the memory a task asks for, so the memory limit is both the hard
+// limit and, on cgroup v1, the soft limit: tasks within their reservation are
+// the last ones reclaimed from under memory pressure. cgroup v2 has no soft
+// limit, and memory.low would shield all the memory of the task from reclaim,
+// so it is left unset.
+type cgroupLimits struct {
+	*drivers.LinuxResources
+
+	// PidsLimit is the maximum number of processes of the task, 0 means
+	// unlimited
+	PidsLimit int64
+}
+
+// taskCgroup is a cgroup created by the driver to enforce the resources of a
+// task. The executor places singularity in it before it runs, so every
+// process of the container is accounted in it.
+type taskCgroup struct {
+	// Version is the cgroup version the cgroup was created with
+	Version int
+
+	// Paths holds the cgroup directory of each controller, or the single
+	// directory of the unified hierarchy
+	Paths map[string]string
+}
+
+// cgroupMounts describes the cgroup hierarchies mounted on the node
+type cgroupMounts struct {
+	// Version is the cgroup version used to enforce task resources
+	Version int
+
+	// Unified is the mount point of the cgroup v2 hierarchy
+	Unified string
+
+	// Controllers holds the mount point of each cgroup v1 controller
+	Controllers map[string]string
+}
+
+// cgroupName returns the cgroup name of a task from its id, which is made of
+// the allocation id, the task name and a unique suffix separated by slashes
+func cgroupName(taskID string) string {
+	return strings.Replace(taskID, "/", "-", -1)
+}
+
+// findCgroupMounts returns the cgroup hierarchies mounted on the node. The
+// memory controller can only be bound to a single hierarchy, so nodes
+// running in the hybrid mode still use cgroup v1.
+func findCgroupMounts() (*cgroupMounts, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := &cgroupMounts{Controllers: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// optional fields end with a single hyphen, followed by the
+		// filesystem type, the mount source and the super block options
+		parts := strings.SplitN(scanner.Text(), " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		super := strings.Fields(parts[1])
+		if len(fields) < 5 || len(super) < 3 {
+			continue
+		}
+		switch super[0] {
+		case "cgroup":
+			for _, opt := range strings.Split(super[2], ",") {
+				if _, ok := mounts.Controllers[opt]; !ok {
+					mounts.Controllers[opt] = fields[4]
+				}
+			}
+		case "cgroup2":
+			if mounts.Unified == "" {
+				mounts.Unified = fields[4]
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case mounts.Controllers["memory"] != "":
+		mounts.Version = cgroupV1
+	case mounts.Unified != "":
+		mounts.Version = cgroupV2
+	default:
+		return nil, fmt.Errorf("no cgroup hierarchy is mounted")
+	}
+	return mounts, nil
+}
+
+// newTaskCgroup creates the cgroup name and applies the limits to it
+func newTaskCgroup(mounts *cgroupMounts, name string, limits *cgroupLimits) (*taskCgroup, error) {
+	var cg *taskCgroup
+	var err error
+	if mounts.Version == cgroupV2 {
+		cg, err = newTaskCgroupV2(mounts.Unified, name, limits)
+	} else {
+		cg, err = newTaskCgroupV1(mounts.Controllers, name, limits)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cg.apply(limits); err != nil {
+		cg.destroy()
+		return nil, err
+	}
+	return cg, nil
+}
+
+// apply writes the resource limits to the cgroup
+func (c *taskCgroup) apply(limits *cgroupLimits) error {
+	if c.Version == cgroupV2 {
+		return c.applyV2(limits)
+	}
+	return c.applyV1(limits)
+}
+
+// dirs returns the cgroup directories a process has to join
+func (c *taskCgroup) dirs() []string {
+	seen := make(map[string]struct{}, len(c.Paths))
+	dirs := make([]string, 0, len(c.Paths))
+	for _, dir := range c.Paths {
+		// controllers may be co-mounted in a single hierarchy
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// destroy removes the cgroup directories. Killed processes stay accounted in
+// the cgroup until they are reaped, so the removal is retried while the
+// cgroup is busy.
+func (c *taskCgroup) destroy() error {
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		busy, err := c.remove()
+		if !busy || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(cgroupRemoveInterval)
+	}
+}
+
+// remove removes the cgroup directories, busy is true if some of them still
+// hold processes
+func (c *taskCgroup) remove() (busy bool, err error) {
+	for _, dir := range c.dirs() {
+		rerr := os.Remove(dir)
+		if rerr == nil || os.IsNotExist(rerr) {
+			continue
+		}
+		if pe, ok := rerr.(*os.PathError); ok && pe.Err == syscall.EBUSY {
+			busy = true
+		}
+		if err == nil {
+			err = fmt.Errorf("failed to remove cgroup %s: %v", dir, rerr)
+		}
+	}
+	return busy, err
+}
+
+// stats returns the memory and cpu usage accounted in the cgroup along with
+// the name of the stats it measured
+func (c *taskCgroup) stats() (*drivers.MemoryStats, *drivers.CpuStats, error) {
+	if c.Version == cgroupV2 {
+		return c.statsV2()
+	}
+	return c.statsV1()
+}
+
+// oomKilled returns true if the kernel killed a process of the cgroup
+// because it ran out of memory
+func (c *taskCgroup) oomKilled() (bool, error) {
+	if c.Version == cgroupV2 {
+		return c.oomKilledV2()
+	}
+	return c.oomKilledV1()
+}
+
+// readCgroupFile returns the trimmed content of a cgroup file
+func readCgroupFile(dir, file string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return "", fmt.Errorf("failed to read cgroup file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readCgroupStat parses a flat keyed cgroup file such as memory.stat
+func readCgroupStat(dir, file string) (map[string]uint64, error) {
+	data, err := readCgroupFile(dir, file)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := make(map[string]uint64)
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			stat[fields[0]] = v
+		}
+	}
+	return stat, nil
+}
+
+// writeCgroupFile writes value to a cgroup file
+func writeCgroupFile(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write cgroup file: %v", err)
+	}
+	return nil
+}
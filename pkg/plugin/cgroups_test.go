@@ -0,0 +1,189 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestCgroupName(t *testing.T) {
+	got := cgroupName("8e4d1a4a-3d3c-4b1e-b1d3-7d3c1d1e2f3a/mooo/d5f6a1b2")
+	want := "8e4d1a4a-3d3c-4b1e-b1d3-7d3c1d1e2f3a-mooo-d5f6a1b2"
+	if got != want {
+		t.Errorf("cgroupName() = %q, want %q", got, want)
+	}
+}
+
+func TestTaskCgroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must be root to create cgroups")
+	}
+
+	mounts, err := findCgroupMounts()
+	if err != nil || mounts.Version != cgroupV1 {
+		t.Skip("cgroup v1 not available")
+	}
+
+	limits := &cgroupLimits{
+		LinuxResources: &drivers.LinuxResources{
+			CPUShares:        512,
+			MemoryLimitBytes: 256 * 1024 * 1024,
+		},
+	}
+	cg, err := newTaskCgroup(mounts, "test-task-cgroup", limits)
+	if err != nil {
+		t.Skipf("cgroups not available: %v", err)
+	}
+	defer cg.destroy()
+
+	if v, err := readCgroupFile(cg.Paths["memory"], "memory.limit_in_bytes"); err != nil || v != "268435456" {
+		t.Errorf("unexpected memory limit %q: %v", v, err)
+	}
+	if v, err := readCgroupFile(cg.Paths["cpu"], "cpu.shares"); err != nil || v != "512" {
+		t.Errorf("unexpected cpu shares %q: %v", v, err)
+	}
+
+	if _, _, err := cg.stats(); err != nil {
+		t.Errorf("failed to read cgroup stats: %v", err)
+	}
+
+	if err := cg.destroy(); err != nil {
+		t.Fatalf("failed to destroy cgroup: %v", err)
+	}
+	if _, err := os.Stat(cg.Paths["memory"]); !os.IsNotExist(err) {
+		t.Errorf("cgroup %s still exists", cg.Paths["memory"])
+	}
+}
+
+func TestCPUWeight(t *testing.T) {
+	for _, tc := range []struct {
+		shares int64
+		weight int64
+	}{
+		{0, 1},
+		{2, 1},
+		{1024, 39},
+		{262144, 10000},
+		{1 << 20, 10000},
+	} {
+		if got := cpuWeight(tc.shares); got != tc.weight {
+			t.Errorf("cpuWeight(%d) = %d, want %d", tc.shares, got, tc.weight)
+		}
+	}
+}
+
+func TestTaskCgroupV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cg := &taskCgroup{
+		Version: cgroupV2,
+		Paths:   map[string]string{cgroupUnified: dir},
+	}
+	limits := &cgroupLimits{
+		LinuxResources: &drivers.LinuxResources{
+			CPUShares:        1024,
+			CPUQuota:         50000,
+			CPUPeriod:        100000,
+			MemoryLimitBytes: 256 * 1024 * 1024,
+		},
+		PidsLimit: 64,
+	}
+	if err := cg.apply(limits); err != nil {
+		t.Fatalf("failed to apply limits: %v", err)
+	}
+
+	for file, want := range map[string]string{
+		"cpu.weight": "39",
+		"cpu.max":    "50000 100000",
+		"memory.max": "268435456",
+		"pids.max":   "64",
+	} {
+		if v, err := readCgroupFile(dir, file); err != nil || v != want {
+			t.Errorf("unexpected %s %q: %v", file, v, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cpuset.cpus")); !os.IsNotExist(err) {
+		t.Errorf("cpuset.cpus written without a cpuset")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "memory.low")); !os.IsNotExist(err) {
+		t.Errorf("memory.low written, protecting all the task memory from reclaim")
+	}
+
+	for file, content := range map[string]string{
+		"memory.stat":    "anon 4096\nfile 8192\nkernel 1024\n",
+		"memory.current": "13312\n",
+		"cpu.stat":       "usage_usec 100\nnr_throttled 3\nthrottled_usec 20\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ms, cs, err := cg.stats()
+	if err != nil {
+		t.Fatalf("failed to read cgroup stats: %v", err)
+	}
+	if ms.Cache != 8192 || ms.KernelUsage != 1024 || ms.Usage != 13312 {
+		t.Errorf("unexpected memory stats %+v", ms)
+	}
+	if !containsString(ms.Measured, "Usage") || containsString(ms.Measured, "Max Usage") {
+		t.Errorf("unexpected measured memory stats %v", ms.Measured)
+	}
+	if cs.ThrottledPeriods != 3 || cs.ThrottledTime != 20000 {
+		t.Errorf("unexpected cpu stats %+v", cs)
+	}
+}
+
+func TestTaskCgroupOOMKilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-oom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name    string
+		version int
+		files   map[string]string
+		oom     bool
+	}{
+		{"v1 not killed", cgroupV1, map[string]string{"memory.oom_control": "oom_kill_disable 0\nunder_oom 0\noom_kill 0\n"}, false},
+		{"v1 killed", cgroupV1, map[string]string{"memory.oom_control": "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n"}, true},
+		{"v1 no oom_kill", cgroupV1, map[string]string{"memory.oom_control": "oom_kill_disable 0\nunder_oom 0\n", "memory.failcnt": "4\n"}, false},
+		{"v2 not killed", cgroupV2, map[string]string{"memory.events": "low 0\nhigh 0\nmax 3\noom 0\noom_kill 0\n"}, false},
+		{"v2 killed", cgroupV2, map[string]string{"memory.events": "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"}, true},
+	} {
+		cgDir := filepath.Join(dir, tc.name)
+		if err := os.Mkdir(cgDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for file, content := range tc.files {
+			if err := ioutil.WriteFile(filepath.Join(cgDir, file), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cg := &taskCgroup{Version: tc.version, Paths: map[string]string{"memory": cgDir}}
+		if tc.version == cgroupV2 {
+			cg.Paths = map[string]string{cgroupUnified: cgDir}
+		}
+		oom, err := cg.oomKilled()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if oom != tc.oom {
+			t.Errorf("%s: oomKilled() = %v, want %v", tc.name, oom, tc.oom)
+		}
+	}
+}
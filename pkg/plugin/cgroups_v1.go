@@ -0,0 +1,184 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// newTaskCgroupV1 creates the cgroup name in each controller hierarchy the
+// limits require
+func newTaskCgroupV1(mounts map[string]string, name string, limits *cgroupLimits) (*taskCgroup, error) {
+	controllers := []string{"cpu", "cpuacct", "memory"}
+	if limits.CpusetCPUs != "" {
+		controllers = append(controllers, "cpuset")
+	}
+	if limits.PidsLimit > 0 {
+		controllers = append(controllers, "pids")
+	}
+
+	cg := &taskCgroup{Version: cgroupV1, Paths: make(map[string]string)}
+	for _, c := range controllers {
+		mount, ok := mounts[c]
+		if !ok {
+			cg.destroy()
+			return nil, fmt.Errorf("cgroup controller %s is not mounted", c)
+		}
+		dir := filepath.Join(mount, cgroupParent, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			cg.destroy()
+			return nil, fmt.Errorf("failed to create cgroup: %v", err)
+		}
+		cg.Paths[c] = dir
+	}
+	return cg, nil
+}
+
+// applyV1 writes the limits to the cgroup v1 controllers
+func (c *taskCgroup) applyV1(limits *cgroupLimits) error {
+	if dir, ok := c.Paths["cpuset"]; ok {
+		// a cpuset cgroup can't hold any process until its cpus and
+		// mems are set, which are empty on creation
+		for _, d := range []string{filepath.Dir(dir), dir} {
+			if err := inheritCpuset(d); err != nil {
+				return err
+			}
+		}
+		if err := writeCgroupFile(dir, "cpuset.cpus", limits.CpusetCPUs); err != nil {
+			return err
+		}
+		if limits.CpusetMems != "" {
+			if err := writeCgroupFile(dir, "cpuset.mems", limits.CpusetMems); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dir := c.Paths["cpu"]; limits.CPUShares > 0 {
+		if err := writeCgroupFile(dir, "cpu.shares", strconv.FormatInt(limits.CPUShares, 10)); err != nil {
+			return err
+		}
+	}
+	if dir := c.Paths["cpu"]; limits.CPUQuota > 0 && limits.CPUPeriod > 0 {
+		if err := writeCgroupFile(dir, "cpu.cfs_period_us", strconv.FormatInt(limits.CPUPeriod, 10)); err != nil {
+			return err
+		}
+		if err := writeCgroupFile(dir, "cpu.cfs_quota_us", strconv.FormatInt(limits.CPUQuota, 10)); err != nil {
+			return err
+		}
+	}
+
+	if dir := c.Paths["memory"]; limits.MemoryLimitBytes > 0 {
+		limit := strconv.FormatInt(limits.MemoryLimitBytes, 10)
+		if err := writeCgroupFile(dir, "memory.limit_in_bytes", limit); err != nil {
+			return err
+		}
+		if err := writeCgroupFile(dir, "memory.soft_limit_in_bytes", limit); err != nil {
+			return err
+		}
+	}
+
+	if dir, ok := c.Paths["pids"]; ok {
+		if err := writeCgroupFile(dir, "pids.max", strconv.FormatInt(limits.PidsLimit, 10)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statsV1 returns the usage accounted by the cgroup v1 controllers
+func (c *taskCgroup) statsV1() (*drivers.MemoryStats, *drivers.CpuStats, error) {
+	ms := &drivers.MemoryStats{}
+	if dir, ok := c.Paths["memory"]; ok {
+		stat, err := readCgroupStat(dir, "memory.stat")
+		if err != nil {
+			return nil, nil, err
+		}
+		ms.Cache = stat["total_cache"]
+		ms.Measured = append(ms.Measured, "Cache")
+		if swap, ok := stat["total_swap"]; ok {
+			ms.Swap = swap
+			ms.Measured = append(ms.Measured, "Swap")
+		}
+
+		for _, f := range []struct {
+			file  string
+			name  string
+			value *uint64
+		}{
+			{"memory.usage_in_bytes", "Usage", &ms.Usage},
+			{"memory.max_usage_in_bytes", "Max Usage", &ms.MaxUsage},
+			{"memory.kmem.usage_in_bytes", "Kernel Usage", &ms.KernelUsage},
+			{"memory.kmem.max_usage_in_bytes", "Kernel Max Usage", &ms.KernelMaxUsage},
+		} {
+			v, err := readCgroupFile(dir, f.file)
+			if err != nil {
+				// kernel memory accounting may be disabled
+				continue
+			}
+			if *f.value, err = strconv.ParseUint(v, 10, 64); err == nil {
+				ms.Measured = append(ms.Measured, f.name)
+			}
+		}
+	}
+
+	cs := &drivers.CpuStats{}
+	if dir, ok := c.Paths["cpu"]; ok {
+		stat, err := readCgroupStat(dir, "cpu.stat")
+		if err != nil {
+			return nil, nil, err
+		}
+		cs.ThrottledPeriods = stat["nr_throttled"]
+		cs.ThrottledTime = stat["throttled_time"]
+		cs.Measured = []string{"Throttled Periods", "Throttled Time"}
+	}
+
+	return ms, cs, nil
+}
+
+// oomKilledV1 reports the oom kills recorded by the memory controller
+func (c *taskCgroup) oomKilledV1() (bool, error) {
+	dir, ok := c.Paths["memory"]
+	if !ok {
+		return false, nil
+	}
+
+	stat, err := readCgroupStat(dir, "memory.oom_control")
+	if err != nil {
+		return false, err
+	}
+	// kernels older than 4.13 don't count oom kills. Hitting the memory
+	// limit only makes the kernel reclaim memory, so no kill is reported.
+	return stat["oom_kill"] > 0, nil
+}
+
+// inheritCpuset copies the cpus and mems of the parent cgroup to dir when
+// they are not set yet
+func inheritCpuset(dir string) error {
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		current, err := readCgroupFile(dir, file)
+		if err != nil {
+			return err
+		}
+		if current != "" {
+			continue
+		}
+		parent, err := readCgroupFile(filepath.Dir(dir), file)
+		if err != nil {
+			return err
+		}
+		if err := writeCgroupFile(dir, file, parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
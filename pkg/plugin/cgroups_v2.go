@@ -0,0 +1,183 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// newTaskCgroupV2 creates the cgroup name in the unified hierarchy mounted
+// at mount, after enabling the controllers the limits require for it
+func newTaskCgroupV2(mount, name string, limits *cgroupLimits) (*taskCgroup, error) {
+	controllers := []string{"cpu", "memory", "pids"}
+	if limits.CpusetCPUs != "" {
+		controllers = append(controllers, "cpuset")
+	}
+
+	available, err := readCgroupFile(mount, "cgroup.controllers")
+	if err != nil {
+		return nil, err
+	}
+	enable := make([]string, 0, len(controllers))
+	for _, c := range controllers {
+		if !containsString(strings.Fields(available), c) {
+			return nil, fmt.Errorf("cgroup controller %s is not available", c)
+		}
+		enable = append(enable, "+"+c)
+	}
+
+	parent := filepath.Join(mount, cgroupParent)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %v", err)
+	}
+
+	// controllers are only available to a cgroup once enabled in the
+	// cgroup.subtree_control of all its ancestors
+	for _, dir := range []string{mount, parent} {
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := filepath.Join(parent, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	return &taskCgroup{
+		Version: cgroupV2,
+		Paths:   map[string]string{cgroupUnified: dir},
+	}, nil
+}
+
+// cpuWeight converts cgroup v1 cpu shares, which range from 2 to 262144, to
+// a cgroup v2 cpu weight ranging from 1 to 10000
+func cpuWeight(shares int64) int64 {
+	if shares < 2 {
+		shares = 2
+	} else if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+// applyV2 writes the limits to the unified cgroup
+func (c *taskCgroup) applyV2(limits *cgroupLimits) error {
+	dir := c.Paths[cgroupUnified]
+
+	if limits.CpusetCPUs != "" {
+		if err := writeCgroupFile(dir, "cpuset.cpus", limits.CpusetCPUs); err != nil {
+			return err
+		}
+	}
+	if limits.CpusetMems != "" {
+		if err := writeCgroupFile(dir, "cpuset.mems", limits.CpusetMems); err != nil {
+			return err
+		}
+	}
+
+	if limits.CPUShares > 0 {
+		weight := strconv.FormatInt(cpuWeight(limits.CPUShares), 10)
+		if err := writeCgroupFile(dir, "cpu.weight", weight); err != nil {
+			return err
+		}
+	}
+	if limits.CPUQuota > 0 && limits.CPUPeriod > 0 {
+		max := fmt.Sprintf("%d %d", limits.CPUQuota, limits.CPUPeriod)
+		if err := writeCgroupFile(dir, "cpu.max", max); err != nil {
+			return err
+		}
+	}
+
+	if limits.MemoryLimitBytes > 0 {
+		limit := strconv.FormatInt(limits.MemoryLimitBytes, 10)
+		if err := writeCgroupFile(dir, "memory.max", limit); err != nil {
+			return err
+		}
+	}
+
+	if limits.PidsLimit > 0 {
+		if err := writeCgroupFile(dir, "pids.max", strconv.FormatInt(limits.PidsLimit, 10)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statsV2 returns the usage accounted by the unified cgroup
+func (c *taskCgroup) statsV2() (*drivers.MemoryStats, *drivers.CpuStats, error) {
+	dir := c.Paths[cgroupUnified]
+
+	stat, err := readCgroupStat(dir, "memory.stat")
+	if err != nil {
+		return nil, nil, err
+	}
+	ms := &drivers.MemoryStats{
+		Cache:    stat["file"],
+		Measured: []string{"Cache"},
+	}
+	if kernel, ok := stat["kernel"]; ok {
+		ms.KernelUsage = kernel
+		ms.Measured = append(ms.Measured, "Kernel Usage")
+	}
+
+	for _, f := range []struct {
+		file  string
+		name  string
+		value *uint64
+	}{
+		{"memory.current", "Usage", &ms.Usage},
+		{"memory.peak", "Max Usage", &ms.MaxUsage},
+		{"memory.swap.current", "Swap", &ms.Swap},
+	} {
+		v, err := readCgroupFile(dir, f.file)
+		if err != nil {
+			// older kernels don't track the peak usage and swap
+			// accounting may be disabled
+			continue
+		}
+		if *f.value, err = strconv.ParseUint(v, 10, 64); err == nil {
+			ms.Measured = append(ms.Measured, f.name)
+		}
+	}
+
+	cpuStat, err := readCgroupStat(dir, "cpu.stat")
+	if err != nil {
+		return nil, nil, err
+	}
+	cs := &drivers.CpuStats{
+		ThrottledPeriods: cpuStat["nr_throttled"],
+		ThrottledTime:    cpuStat["throttled_usec"] * 1000,
+		Measured:         []string{"Throttled Periods", "Throttled Time"},
+	}
+
+	return ms, cs, nil
+}
+
+// oomKilledV2 reports the oom kills recorded in memory.events
+func (c *taskCgroup) oomKilledV2() (bool, error) {
+	events, err := readCgroupStat(c.Paths[cgroupUnified], "memory.events")
+	if err != nil {
+		return false, err
+	}
+	return events["oom_kill"] > 0, nil
+}
+
+// containsString returns true if s is in list
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
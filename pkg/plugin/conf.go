@@ -0,0 +1,175 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+const (
+	// defaultSysconfdir is the SYSCONFDIR of singularity installed from
+	// source, used when buildcfg doesn't report it
+	defaultSysconfdir = "/usr/local/etc"
+)
+
+// singularityConf holds the directives of a singularity.conf file. Directives
+// such as "bind path" may be repeated, so all their values are kept.
+type singularityConf struct {
+	Path   string
+	values map[string][]string
+}
+
+// confPath returns the path of the configuration file of a runtime from its
+// build configuration
+func confPath(flavor string, buildcfg map[string]string) string {
+	prefix := strings.ToUpper(flavor)
+	if path := buildcfg[prefix+"_CONF_FILE"]; path != "" {
+		return path
+	}
+	if dir := buildcfg[prefix+"_CONFDIR"]; dir != "" {
+		return filepath.Join(dir, flavor+".conf")
+	}
+
+	sysconfdir := buildcfg["SYSCONFDIR"]
+	if sysconfdir == "" {
+		sysconfdir = defaultSysconfdir
+	}
+	return filepath.Join(sysconfdir, flavor, flavor+".conf")
+}
+
+// loadSingularityConf parses the singularity.conf file at path
+func loadSingularityConf(path string) (*singularityConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	conf := &singularityConf{
+		Path:   path,
+		values: make(map[string][]string),
+	}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("failed to parse %s: invalid directive at line %d", path, n)
+		}
+		key := strings.ToLower(strings.Join(strings.Fields(kv[0]), " "))
+		conf.values[key] = append(conf.values[key], strings.TrimSpace(kv[1]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return conf, nil
+}
+
+// value returns the last value of the directive key, or def if it is not set
+func (c *singularityConf) value(key, def string) string {
+	values := c.values[key]
+	if len(values) == 0 {
+		return def
+	}
+	return values[len(values)-1]
+}
+
+// boolValue returns the yes/no value of the directive key, or def if it is
+// not set or invalid
+func (c *singularityConf) boolValue(key string, def bool) bool {
+	switch strings.ToLower(c.value(key, "")) {
+	case "yes":
+		return true
+	case "no":
+		return false
+	}
+	return def
+}
+
+// attributes adds the policy set by the configuration to attrs, the defaults
+// are the ones of singularity when a directive is not set
+func (c *singularityConf) attributes(attrs map[string]*pstructs.Attribute, prefix string) {
+	attrs[prefix+".allow_setuid"] = pstructs.NewBoolAttribute(c.boolValue("allow setuid", true))
+	attrs[prefix+".user_bind_control"] = pstructs.NewBoolAttribute(c.boolValue("user bind control", true))
+	attrs[prefix+".enable_overlay"] = pstructs.NewStringAttribute(strings.ToLower(c.value("enable overlay", "try")))
+
+	if max, err := strconv.ParseInt(c.value("max loop devices", "256"), 10, 64); err == nil {
+		attrs[prefix+".max_loop_devices"] = pstructs.NewIntAttribute(max, "")
+	}
+	if owners := c.value("limit container owners", ""); owners != "" {
+		attrs[prefix+".limit_container_owners"] = pstructs.NewStringAttribute(owners)
+	}
+	if paths := c.value("limit container paths", ""); paths != "" {
+		attrs[prefix+".limit_container_paths"] = pstructs.NewStringAttribute(paths)
+	}
+}
+
+// listValue returns the comma separated values of the directive key
+func (c *singularityConf) listValue(key string) []string {
+	var values []string
+	for _, v := range strings.Split(c.value(key, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// validate returns an error if the configuration forbids what the task
+// requires. Local images, relative ones being found from taskDir, must be
+// below the limit container paths and owned by the limit container owners.
+func (c *singularityConf) validate(taskDir string, taskCfg TaskConfig) error {
+	if len(taskCfg.Overlay) != 0 && strings.ToLower(c.value("enable overlay", "try")) == "no" {
+		return fmt.Errorf("overlay is disabled by %s", c.Path)
+	}
+	if imageScheme(taskCfg.Image) != "" {
+		return nil
+	}
+
+	image := bindSource(taskDir, taskCfg.Image)
+	if paths := c.listValue("limit container paths"); len(paths) != 0 && !pathAllowed(paths, image) {
+		return fmt.Errorf("image %s is not in the limit container paths of %s", image, c.Path)
+	}
+	if owners := c.listValue("limit container owners"); len(owners) != 0 {
+		// a missing image is reported by the runtime
+		fi, err := os.Stat(image)
+		if err != nil {
+			return nil
+		}
+		if !ownedBy(fi, owners) {
+			return fmt.Errorf("image %s is not owned by the limit container owners of %s", image, c.Path)
+		}
+	}
+	return nil
+}
+
+// ownedBy returns true if the file fi is owned by one of the users named by
+// owners
+func ownedBy(fi os.FileInfo, owners []string) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	uid := strconv.FormatUint(uint64(st.Uid), 10)
+	for _, name := range owners {
+		if u, err := user.Lookup(name); err == nil && u.Uid == uid {
+			return true
+		}
+	}
+	return false
+}
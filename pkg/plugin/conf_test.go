@@ -0,0 +1,144 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+const testConf = `# SINGULARITY.CONF
+allow setuid = yes
+max loop devices = 128
+
+# overlays are not supported by the kernel
+enable overlay = no
+user bind control = no
+
+bind path = /etc/localtime
+bind path = /etc/hosts
+limit container owners = root, admin
+`
+
+func TestConfPath(t *testing.T) {
+	for _, tc := range []struct {
+		flavor   string
+		buildcfg map[string]string
+		want     string
+	}{
+		{flavorSingularity, map[string]string{}, "/usr/local/etc/singularity/singularity.conf"},
+		{flavorSingularity, map[string]string{"SYSCONFDIR": "/etc"}, "/etc/singularity/singularity.conf"},
+		{flavorApptainer, map[string]string{"APPTAINER_CONFDIR": "/etc/apptainer"}, "/etc/apptainer/apptainer.conf"},
+		{flavorSingularity, map[string]string{"SINGULARITY_CONF_FILE": "/opt/s.conf"}, "/opt/s.conf"},
+	} {
+		if got := confPath(tc.flavor, tc.buildcfg); got != tc.want {
+			t.Errorf("confPath(%s, %v) = %q, want %q", tc.flavor, tc.buildcfg, got, tc.want)
+		}
+	}
+}
+
+func TestLoadSingularityConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "singularity.conf")
+	if err := ioutil.WriteFile(path, []byte(testConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := loadSingularityConf(path)
+	if err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+	if binds := conf.values["bind path"]; len(binds) != 2 {
+		t.Errorf("expected 2 bind paths, got %v", binds)
+	}
+
+	attrs := make(map[string]*pstructs.Attribute)
+	conf.attributes(attrs, "driver.singularity.conf")
+	for attr, want := range map[string]string{
+		"driver.singularity.conf.allow_setuid":           "true",
+		"driver.singularity.conf.user_bind_control":      "false",
+		"driver.singularity.conf.enable_overlay":         "no",
+		"driver.singularity.conf.max_loop_devices":       "128",
+		"driver.singularity.conf.limit_container_owners": "root, admin",
+	} {
+		if got, ok := attrs[attr]; !ok || got.GoString() != want {
+			t.Errorf("unexpected attribute %s = %v, want %s", attr, got, want)
+		}
+	}
+	if _, ok := attrs["driver.singularity.conf.limit_container_paths"]; ok {
+		t.Errorf("unexpected limit_container_paths attribute")
+	}
+
+	if err := conf.validate(dir, TaskConfig{}); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+	if err := conf.validate(dir, TaskConfig{Overlay: []string{"overlay.img"}}); err == nil {
+		t.Errorf("expected overlay to be rejected")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("allow setuid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSingularityConf(path); err == nil {
+		t.Errorf("expected an error for an invalid directive")
+	}
+}
+
+func TestSingularityConf_ValidateImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	images := filepath.Join(dir, "images")
+	if err := os.MkdirAll(images, 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(images, "app.sif")
+	if err := ioutil.WriteFile(image, []byte("sif"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		conf  map[string][]string
+		image string
+		ok    bool
+	}{
+		{"no limits", nil, image, true},
+		{"allowed path", map[string][]string{"limit container paths": {"/nonexistent, " + images}}, image, true},
+		{"relative path", map[string][]string{"limit container paths": {images}}, "images/app.sif", true},
+		{"denied path", map[string][]string{"limit container paths": {"/nonexistent"}}, image, false},
+		{"escaping path", map[string][]string{"limit container paths": {images}}, "images/../app.sif", false},
+		{"allowed owner", map[string][]string{"limit container owners": {"nonexistent, " + current.Username}}, image, true},
+		{"denied owner", map[string][]string{"limit container owners": {"nonexistent"}}, image, false},
+		{"remote image", map[string][]string{"limit container paths": {"/nonexistent"}}, "docker://alpine", true},
+	} {
+		conf := &singularityConf{Path: "singularity.conf", values: tc.conf}
+		err := conf.validate(dir, TaskConfig{Image: tc.image})
+		if tc.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected image %s to be rejected", tc.name, tc.image)
+		}
+	}
+}
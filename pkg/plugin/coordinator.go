@@ -0,0 +1,302 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// imagePull is an in-flight pull of an image
+type imagePull struct {
+	// doneCh is closed once the pull completed, err is set before
+	doneCh chan struct{}
+	err    error
+
+	// waiters is the number of tasks waiting for the pull, whose references
+	// are held as soon as it completes
+	waiters int
+}
+
+// imageGCConfig configures the removal of the images no task uses
+type imageGCConfig struct {
+	// enabled turns on the garbage collection of images
+	enabled bool
+
+	// delay is how long an unused image is kept before being removed
+	delay time.Duration
+
+	// dir is the directory of the cached images
+	dir string
+
+	// maxCacheSize is the size in bytes the cached images are kept under
+	// by removing the least recently used ones, 0 means unlimited
+	maxCacheSize int64
+
+	// keep holds the ids of the images never removed, whatever the
+	// credentials they were pulled with
+	keep map[string]struct{}
+}
+
+// imageCoordinator serialises the pulls of the images of the node, so that
+// tasks starting concurrently share a single pull of their image, and counts
+// the tasks using each pulled image to remove the unused ones.
+type imageCoordinator struct {
+	logger hclog.Logger
+
+	// lock syncs access to all fields below
+	lock sync.Mutex
+
+	// gc configures the removal of unused images
+	gc imageGCConfig
+
+	// pulls holds the in-flight pulls by image path
+	pulls map[string]*imagePull
+
+	// refs holds the number of tasks using each image path
+	refs map[string]int
+
+	// lastUsed holds the last time each image was acquired or released
+	lastUsed map[string]time.Time
+
+	// timers holds the pending removals of unused images
+	timers map[string]*time.Timer
+}
+
+func newImageCoordinator(logger hclog.Logger) *imageCoordinator {
+	return &imageCoordinator{
+		logger:   logger.Named("image_coordinator"),
+		pulls:    make(map[string]*imagePull),
+		refs:     make(map[string]int),
+		lastUsed: make(map[string]time.Time),
+		timers:   make(map[string]*time.Timer),
+	}
+}
+
+// setGC sets the garbage collection configuration and schedules the removal
+// of the cached images no task uses, such as the ones left behind by a
+// previous run of the plugin. Tasks recovered before the gc delay expires
+// cancel the removal of their image.
+func (c *imageCoordinator) setGC(gc imageGCConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gc = gc
+	if !gc.enabled || gc.dir == "" {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(gc.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.logger.Warn("failed to list cached images", "error", err)
+		}
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".sif" {
+			continue
+		}
+		path := filepath.Join(gc.dir, e.Name())
+		if c.usedLocked(path) || c.kept(path) {
+			continue
+		}
+		c.scheduleRemoval(path)
+	}
+}
+
+// acquire makes the image at path available and holds a reference to it until
+// release is called. If no other task is pulling the image, pull is called to
+// fetch it, otherwise acquire waits for the in-flight pull and shares its
+// result, along with a reference held on its behalf.
+func (c *imageCoordinator) acquire(path string, pull func() error) error {
+	c.lock.Lock()
+	if p, ok := c.pulls[path]; ok {
+		p.waiters++
+		c.lock.Unlock()
+		<-p.doneCh
+		return p.err
+	}
+
+	p := &imagePull{doneCh: make(chan struct{})}
+	c.pulls[path] = p
+	c.lock.Unlock()
+
+	p.err = pull()
+
+	// the waiters hold their reference before the lock is released, so
+	// that a task releasing the image in the meantime can't remove it
+	c.lock.Lock()
+	delete(c.pulls, path)
+	if p.err == nil {
+		for i := 0; i <= p.waiters; i++ {
+			c.use(path)
+		}
+		c.enforceCacheSize()
+	}
+	c.lock.Unlock()
+	close(p.doneCh)
+
+	return p.err
+}
+
+// retain holds a reference to the image at path, which is already available
+func (c *imageCoordinator) retain(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.use(path)
+}
+
+// use records a new reference to the image at path and cancels its pending
+// removal, c.lock must be held
+func (c *imageCoordinator) use(path string) {
+	c.refs[path]++
+	c.lastUsed[path] = time.Now()
+	if timer, ok := c.timers[path]; ok {
+		timer.Stop()
+		delete(c.timers, path)
+	}
+}
+
+// release drops a reference to the image at path, which is removed after the
+// gc delay once no task uses it
+func (c *imageCoordinator) release(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastUsed[path] = time.Now()
+	if c.refs[path] > 1 {
+		c.refs[path]--
+		return
+	}
+	delete(c.refs, path)
+
+	if !c.gc.enabled {
+		return
+	}
+	c.scheduleRemoval(path)
+	c.enforceCacheSize()
+}
+
+// scheduleRemoval removes the image at path after the gc delay unless a task
+// uses it by then, c.lock must be held
+func (c *imageCoordinator) scheduleRemoval(path string) {
+	if _, ok := c.timers[path]; ok {
+		return
+	}
+	c.timers[path] = time.AfterFunc(c.gc.delay, func() {
+		c.removeUnused(path)
+	})
+}
+
+// removeUnused removes the image at path unless a task started using it
+func (c *imageCoordinator) removeUnused(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.timers, path)
+	if c.usedLocked(path) {
+		return
+	}
+	c.remove(path)
+}
+
+// remove deletes the image at path unless it must be kept, c.lock must be
+// held
+func (c *imageCoordinator) remove(path string) bool {
+	if c.kept(path) {
+		return false
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		c.logger.Warn("failed to remove unused image", "path", path, "error", err)
+		return false
+	}
+	c.logger.Debug("removed unused image", "path", path)
+	delete(c.lastUsed, path)
+	return true
+}
+
+// kept returns true if the image at path is in the keep list, whatever the
+// credentials it was pulled with
+func (c *imageCoordinator) kept(path string) bool {
+	id := strings.SplitN(strings.TrimSuffix(filepath.Base(path), ".sif"), "-", 2)[0]
+	_, ok := c.gc.keep[id]
+	return ok
+}
+
+// enforceCacheSize removes the least recently used images until the cached
+// images fit in the maximum cache size, c.lock must be held
+func (c *imageCoordinator) enforceCacheSize() {
+	if !c.gc.enabled || c.gc.maxCacheSize <= 0 || c.gc.dir == "" {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(c.gc.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.logger.Warn("failed to list cached images", "error", err)
+		}
+		return
+	}
+
+	type cachedImage struct {
+		path     string
+		size     int64
+		lastUsed time.Time
+	}
+	var total int64
+	var candidates []cachedImage
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".sif" {
+			continue
+		}
+		total += e.Size()
+
+		path := filepath.Join(c.gc.dir, e.Name())
+		if c.usedLocked(path) {
+			continue
+		}
+		// images cached before the plugin started were last used
+		// when pulled
+		lastUsed, ok := c.lastUsed[path]
+		if !ok {
+			lastUsed = e.ModTime()
+		}
+		candidates = append(candidates, cachedImage{path, e.Size(), lastUsed})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+	for _, img := range candidates {
+		if total <= c.gc.maxCacheSize {
+			return
+		}
+		if c.remove(img.path) {
+			total -= img.size
+		}
+	}
+}
+
+// inUse returns true if a task holds a reference to the image at path or is
+// pulling it
+func (c *imageCoordinator) inUse(path string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.usedLocked(path)
+}
+
+// usedLocked is inUse for callers holding c.lock
+func (c *imageCoordinator) usedLocked(path string) bool {
+	_, pulling := c.pulls[path]
+	return pulling || c.refs[path] > 0
+}
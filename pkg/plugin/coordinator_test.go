@@ -0,0 +1,304 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestImageCoordinator_Acquire(t *testing.T) {
+	c := newImageCoordinator(hclog.NewNullLogger())
+
+	var pulls int32
+	release := make(chan struct{})
+	pull := func() error {
+		atomic.AddInt32(&pulls, 1)
+		<-release
+		return nil
+	}
+
+	const tasks = 10
+	var wg sync.WaitGroup
+	errCh := make(chan error, tasks)
+	for i := 0; i < tasks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- c.acquire("/cache/image.sif", pull)
+		}()
+	}
+
+	// let all tasks queue up on the in-flight pull
+	time.Sleep(50 * time.Millisecond)
+	if !c.inUse("/cache/image.sif") {
+		t.Errorf("expected image to be in use while pulled")
+	}
+	close(release)
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&pulls); n != 1 {
+		t.Errorf("expected a single pull, got %d", n)
+	}
+
+	for i := 0; i < tasks; i++ {
+		if !c.inUse("/cache/image.sif") {
+			t.Fatalf("image released after %d of %d tasks", i, tasks)
+		}
+		c.release("/cache/image.sif")
+	}
+	if c.inUse("/cache/image.sif") {
+		t.Errorf("expected image to be unused once all tasks released it")
+	}
+}
+
+func TestImageCoordinator_AcquireWaiterRef(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "image.sif")
+
+	c := newImageCoordinator(hclog.NewNullLogger())
+	c.setGC(imageGCConfig{enabled: true, dir: dir, maxCacheSize: 1})
+
+	release := make(chan struct{})
+	firstCh := make(chan error, 1)
+	go func() {
+		firstCh <- c.acquire(image, func() error {
+			<-release
+			return ioutil.WriteFile(image, []byte("sif"), 0644)
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	waiterCh := make(chan error, 1)
+	go func() {
+		waiterCh <- c.acquire(image, func() error {
+			t.Errorf("unexpected second pull")
+			return nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// the task which pulled the image fails to start right away, the
+	// image must stay for the task which waited for the pull
+	close(release)
+	if err := <-firstCh; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.release(image)
+	if err := <-waiterCh; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !exists(image) {
+		t.Errorf("image removed while a task holds a reference to it")
+	}
+	if !c.inUse(image) {
+		t.Errorf("expected image to be in use by the waiting task")
+	}
+}
+
+func TestImageCoordinator_AcquireError(t *testing.T) {
+	c := newImageCoordinator(hclog.NewNullLogger())
+
+	release := make(chan struct{})
+	pullErr := fmt.Errorf("registry unavailable")
+	pull := func() error {
+		<-release
+		return pullErr
+	}
+
+	errCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errCh <- c.acquire("/cache/image.sif", pull)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != pullErr {
+			t.Errorf("expected the pull error, got %v", err)
+		}
+	}
+	if c.inUse("/cache/image.sif") {
+		t.Errorf("expected failed pull not to hold the image")
+	}
+}
+
+// cachedImage writes an image of size bytes to dir, last modified at mtime
+func cachedImage(t *testing.T, dir, name string, size int, mtime time.Time) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestImageCoordinator_GC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	unused := cachedImage(t, dir, "unused.sif", 10, now)
+	reused := cachedImage(t, dir, "reused.sif", 10, now)
+	kept := cachedImage(t, dir, "kept.sif", 10, now)
+
+	c := newImageCoordinator(hclog.NewNullLogger())
+	c.setGC(imageGCConfig{
+		enabled: true,
+		delay:   50 * time.Millisecond,
+		dir:     dir,
+		keep:    map[string]struct{}{"kept": {}},
+	})
+	for _, path := range []string{unused, reused, kept} {
+		c.retain(path)
+		c.release(path)
+	}
+	// a task using the image before the delay expired cancels its removal
+	c.retain(reused)
+
+	time.Sleep(200 * time.Millisecond)
+	if exists(unused) {
+		t.Errorf("expected unused image to be removed")
+	}
+	if !exists(reused) {
+		t.Errorf("expected image in use to be kept")
+	}
+	if !exists(kept) {
+		t.Errorf("expected image in the keep list to be kept")
+	}
+}
+
+func TestImageCoordinator_GCLeftover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	leftover := cachedImage(t, dir, "leftover.sif", 10, now)
+	recovered := cachedImage(t, dir, "recovered.sif", 10, now)
+	kept := cachedImage(t, dir, "kept.sif", 10, now)
+
+	// images cached by a previous run are removed unless a recovered task
+	// uses them
+	c := newImageCoordinator(hclog.NewNullLogger())
+	c.setGC(imageGCConfig{
+		enabled: true,
+		delay:   50 * time.Millisecond,
+		dir:     dir,
+		keep:    map[string]struct{}{"kept": {}},
+	})
+	c.retain(recovered)
+
+	time.Sleep(200 * time.Millisecond)
+	if exists(leftover) {
+		t.Errorf("expected leftover image to be removed")
+	}
+	if !exists(recovered) {
+		t.Errorf("expected image of the recovered task to be kept")
+	}
+	if !exists(kept) {
+		t.Errorf("expected image in the keep list to be kept")
+	}
+}
+
+func TestImageCoordinator_GCDisabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := cachedImage(t, dir, "image.sif", 10, time.Now())
+
+	c := newImageCoordinator(hclog.NewNullLogger())
+	c.setGC(imageGCConfig{delay: time.Millisecond, dir: dir, maxCacheSize: 1})
+	c.retain(image)
+	c.release(image)
+
+	time.Sleep(50 * time.Millisecond)
+	if !exists(image) {
+		t.Errorf("expected image to be kept when gc is disabled")
+	}
+}
+
+func TestImageCoordinator_MaxCacheSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	oldest := cachedImage(t, dir, "oldest.sif", 10, now.Add(-3*time.Hour))
+	kept := cachedImage(t, dir, "kept.sif", 10, now.Add(-2*time.Hour))
+	used := cachedImage(t, dir, "used.sif", 10, now.Add(-time.Hour))
+	recent := cachedImage(t, dir, "recent.sif", 10, now)
+
+	c := newImageCoordinator(hclog.NewNullLogger())
+	c.setGC(imageGCConfig{
+		enabled:      true,
+		delay:        time.Hour,
+		dir:          dir,
+		maxCacheSize: 25,
+		keep:         map[string]struct{}{"kept": {}},
+	})
+	c.retain(used)
+
+	pulled := filepath.Join(dir, "pulled.sif")
+	err = c.acquire(pulled, func() error {
+		cachedImage(t, dir, "pulled.sif", 10, now)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 50 bytes are cached, the least recently used images are removed
+	// until the cache fits, skipping the kept and used ones
+	for path, want := range map[string]bool{
+		oldest: false,
+		kept:   true,
+		used:   true,
+		recent: false,
+		pulled: true,
+	} {
+		if got := exists(path); got != want {
+			t.Errorf("%s: expected exists=%v, got %v", filepath.Base(path), want, got)
+		}
+	}
+}
@@ -8,6 +8,7 @@ package singularity
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
@@ -16,7 +17,6 @@ import (
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
 	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
-	useragent "github.com/sylabs/singularity/pkg/util/user-agent"
 )
 
 const (
@@ -29,9 +29,6 @@ const (
 	// taskHandleVersion is the version of task handle which this driver sets
 	// and understands how to decode driver state
 	taskHandleVersion = 1
-
-	// singularityBIN is the singularity binary path.
-	singularityBIN = "/usr/local/bin/singularity"
 )
 
 var (
@@ -53,11 +50,58 @@ var (
 			hclspec.NewAttr("no_cgroups", "bool", false),
 			hclspec.NewLiteral("false"),
 		),
+		"pids_limit": hclspec.NewAttr("pids_limit", "number", false),
 		"volumes_enabled": hclspec.NewDefault(
 			hclspec.NewAttr("volumes_enabled", "bool", false),
 			hclspec.NewLiteral("true"),
 		),
 		"singularity_cache": hclspec.NewAttr("singularity_cache", "string", false),
+		"singularity_path":  hclspec.NewAttr("singularity_path", "string", false),
+		"runtimes":          hclspec.NewBlockAttrs("runtimes", "string", false),
+		"image_pull_timeout": hclspec.NewDefault(
+			hclspec.NewAttr("image_pull_timeout", "string", false),
+			hclspec.NewLiteral("\"5m\""),
+		),
+		"allow_keepprivs": hclspec.NewDefault(
+			hclspec.NewAttr("allow_keepprivs", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"allow_fakeroot": hclspec.NewDefault(
+			hclspec.NewAttr("allow_fakeroot", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"allowed_security_options": hclspec.NewAttr("allowed_security_options", "list(string)", false),
+		"allowed_bind_sources":     hclspec.NewAttr("allowed_bind_sources", "list(string)", false),
+		"allowed_images":           hclspec.NewAttr("allowed_images", "list(string)", false),
+		"denied_images":            hclspec.NewAttr("denied_images", "list(string)", false),
+		"verify": hclspec.NewDefault(
+			hclspec.NewAttr("verify", "string", false),
+			hclspec.NewLiteral("\"off\""),
+		),
+		"trusted_keys":          hclspec.NewAttr("trusted_keys", "list(string)", false),
+		"verify_keyring":        hclspec.NewAttr("verify_keyring", "string", false),
+		"allow_verify_override": hclspec.NewAttr("allow_verify_override", "bool", false),
+		"auth_config":           hclspec.NewAttr("auth_config", "string", false),
+		"auth_helper":           hclspec.NewAttr("auth_helper", "string", false),
+		"image_pull_retries": hclspec.NewDefault(
+			hclspec.NewAttr("image_pull_retries", "number", false),
+			hclspec.NewLiteral("3"),
+		),
+		"gc": hclspec.NewDefault(hclspec.NewBlock("gc", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"image": hclspec.NewDefault(
+				hclspec.NewAttr("image", "bool", false),
+				hclspec.NewLiteral("true"),
+			),
+			"image_delay": hclspec.NewDefault(
+				hclspec.NewAttr("image_delay", "string", false),
+				hclspec.NewLiteral("\"3m\""),
+			),
+			"max_cache_size": hclspec.NewAttr("max_cache_size", "number", false),
+			"keep":           hclspec.NewAttr("keep", "list(string)", false),
+		})), hclspec.NewLiteral(`{
+			image = true
+			image_delay = "3m"
+		}`)),
 	})
 
 	// taskConfigSpec is the hcl specification for the driver config section of
@@ -74,6 +118,7 @@ var (
 		"overlay":   hclspec.NewAttr("overlay", "list(string)", false),
 		"security":  hclspec.NewAttr("security", "list(string)", false),
 		"keepprivs": hclspec.NewAttr("keepprivs", "bool", false),
+		"fakeroot":  hclspec.NewAttr("fakeroot", "bool", false),
 		"contain":   hclspec.NewAttr("contain", "bool", false),
 		"home":      hclspec.NewAttr("home", "string", false),
 		"nohome":    hclspec.NewAttr("nohome", "string", false),
@@ -81,6 +126,17 @@ var (
 		"dropcaps":  hclspec.NewAttr("dropcaps", "string", false),
 		"workdir":   hclspec.NewAttr("workdir", "string", false),
 		"pwd":       hclspec.NewAttr("pwd", "string", false),
+		"runtime":   hclspec.NewAttr("runtime", "string", false),
+
+		"image_pull_timeout": hclspec.NewAttr("image_pull_timeout", "string", false),
+		"verify":             hclspec.NewAttr("verify", "string", false),
+		"pem_path":           hclspec.NewAttr("pem_path", "string", false),
+		"passphrase_env":     hclspec.NewAttr("passphrase_env", "string", false),
+		"auth": hclspec.NewBlock("auth", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"username": hclspec.NewAttr("username", "string", false),
+			"password": hclspec.NewAttr("password", "string", false),
+			"token":    hclspec.NewAttr("token", "string", false),
+		})),
 	})
 
 	// capabilities is returned by the Capabilities RPC and indicates what
@@ -118,6 +174,17 @@ type Driver struct {
 
 	// logger will log to the Nomad agent
 	logger hclog.Logger
+
+	// cgroups holds the cgroup hierarchies detected by the last fingerprint
+	cgroups     *cgroupMounts
+	cgroupsLock sync.Mutex
+
+	// images coordinates the pulls of task images
+	images *imageCoordinator
+
+	// runtimes caches the runtimes probed by the fingerprint by binary path
+	runtimes     map[string]*runtimeInfo
+	runtimesLock sync.Mutex
 }
 
 // Config is the driver configuration set by the SetConfig RPC call
@@ -127,7 +194,94 @@ type Config struct {
 
 	AllowVolumes bool `codec:"volumes_enabled"`
 
+	// NoCgroups disables the enforcement of task resources with cgroups
+	NoCgroups bool `codec:"no_cgroups"`
+
+	// PidsLimit is the maximum number of processes of a task, 0 means
+	// unlimited
+	PidsLimit int64 `codec:"pids_limit"`
+
 	SingularityCache string `codec:"singularity_cache"`
+
+	// SingularityPath is the path of the singularity binary of the default
+	// runtime, it is looked up in PATH when empty
+	SingularityPath string `codec:"singularity_path"`
+
+	// Runtimes maps runtime names tasks may select to the path of their
+	// singularity or apptainer binary
+	Runtimes map[string]string `codec:"runtimes"`
+
+	// ImagePullTimeout bounds each attempt to pull a task image
+	ImagePullTimeout         string        `codec:"image_pull_timeout"`
+	imagePullTimeoutDuration time.Duration `codec:"-"`
+
+	// ImagePullRetries is the number of times a pull failing with a
+	// transient error is retried
+	ImagePullRetries int `codec:"image_pull_retries"`
+
+	// AllowKeepPrivs and AllowFakeroot allow tasks to set keepprivs and
+	// fakeroot
+	AllowKeepPrivs bool `codec:"allow_keepprivs"`
+	AllowFakeroot  bool `codec:"allow_fakeroot"`
+
+	// AllowedSecurityOptions lists the security options tasks may set,
+	// either as is or by type such as seccomp, any option is allowed when
+	// empty
+	AllowedSecurityOptions []string `codec:"allowed_security_options"`
+
+	// AllowedBindSources lists the host paths tasks may bind, with the
+	// paths below them, any path is allowed when empty
+	AllowedBindSources []string `codec:"allowed_bind_sources"`
+
+	// AllowedImages and DeniedImages are the rules restricting the images
+	// tasks may run
+	AllowedImages []string     `codec:"allowed_images"`
+	DeniedImages  []string     `codec:"denied_images"`
+	imageAllow    []*imageRule `codec:"-"`
+	imageDeny     []*imageRule `codec:"-"`
+
+	// Verify is the policy applied to the signatures of task images, one of
+	// off, warn or enforce
+	Verify string `codec:"verify"`
+
+	// TrustedKeys lists the fingerprints of the keys task images must be
+	// signed by, any key of the keyring is trusted when empty
+	TrustedKeys []string `codec:"trusted_keys"`
+
+	// VerifyKeyring is the directory of the keyring images are verified
+	// against, the keyring of the user running nomad when empty
+	VerifyKeyring string `codec:"verify_keyring"`
+
+	// AllowVerifyOverride allows tasks to relax the verify policy
+	AllowVerifyOverride bool `codec:"allow_verify_override"`
+
+	// AuthConfig is a docker config file holding the credentials of
+	// registries, or the credential helpers providing them
+	AuthConfig string `codec:"auth_config"`
+
+	// AuthHelper is the docker credential helper used for the registries
+	// without credentials in AuthConfig
+	AuthHelper string `codec:"auth_helper"`
+
+	// GC configures the removal of the cached images no task uses
+	GC GCConfig `codec:"gc"`
+}
+
+// GCConfig is the garbage collection configuration of the cached images
+type GCConfig struct {
+	// Image enables the removal of unused images
+	Image bool `codec:"image"`
+
+	// ImageDelay is how long an unused image is kept in the cache
+	ImageDelay         string        `codec:"image_delay"`
+	imageDelayDuration time.Duration `codec:"-"`
+
+	// MaxCacheSize is the size in bytes above which the least recently used
+	// images are removed, 0 means unlimited
+	MaxCacheSize int64 `codec:"max_cache_size"`
+
+	// Keep lists the images never removed
+	Keep []string `codec:"keep"`
 }
 
 // TaskConfig is the driver configuration of a task within a job
@@ -144,6 +298,7 @@ type TaskConfig struct {
 	Binds     []string `codec:"binds"` // Host-Volumes to mount in, syntax: /path/to/host/directory:/destination/path/in/container
 	Security  []string `codec:"security"`
 	KeepPrivs bool     `codec:"keepprivs"`
+	Fakeroot  bool     `codec:"fakeroot"`
 	DropCaps  string   `codec:"dropcaps"`
 	Contain   bool     `codec:"contain"`
 	NoHome    bool     `codec:"nohome"`
@@ -152,6 +307,26 @@ type TaskConfig struct {
 	Pwd       string   `codec:"pwd"`
 	App       string   `codec:"app"`
 	Overlay   []string `codec:"overlay"`
+
+	// Runtime selects one of the runtimes of the plugin configuration
+	Runtime string `codec:"runtime"`
+
+	// ImagePullTimeout overrides the image_pull_timeout of the plugin
+	ImagePullTimeout string `codec:"image_pull_timeout"`
+
+	// Verify overrides the verify policy of the plugin
+	Verify string `codec:"verify"`
+
+	// PemPath is the private key of an encrypted image, relative to the
+	// secrets directory of the task
+	PemPath string `codec:"pem_path"`
+
+	// PassphraseEnv names the task environment variable holding the
+	// passphrase of an encrypted image
+	PassphraseEnv string `codec:"passphrase_env"`
+
+	// Auth holds the credentials of private images
+	Auth TaskAuth `codec:"auth"`
 }
 
 // TaskState is the state which is encoded in the handle returned in
@@ -162,6 +337,26 @@ type TaskState struct {
 	ContainerName string
 	StartedAt     time.Time
 	PID           int
+
+	// ProcStartTime identifies the container process, so that a process
+	// recycling its pid is never mistaken for it
+	ProcStartTime uint64
+
+	// ExecutorSocket is the unix socket of the executor supervising the
+	// container process
+	ExecutorSocket string
+
+	// CgroupPaths holds the directory of each controller of the cgroup
+	// created for the task, if any
+	CgroupPaths map[string]string
+
+	// CgroupVersion is the version of the cgroup created for the task, 0
+	// designates cgroup v1
+	CgroupVersion int
+
+	// ImagePath is the cached image pulled for the task, empty for tasks
+	// running a local image
+	ImagePath string
 }
 
 // NewSingularityDriver returns a new DriverPlugin implementation
@@ -173,6 +368,7 @@ func NewSingularityDriver(logger hclog.Logger) drivers.DriverPlugin {
 		eventer:        eventer.NewEventer(ctx, logger),
 		config:         &Config{},
 		tasks:          newTaskStore(),
+		images:         newImageCoordinator(logger),
 		ctx:            ctx,
 		signalShutdown: cancel,
 		logger:         logger,
@@ -198,7 +394,45 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		}
 	}
 
+	if config.ImagePullTimeout != "" {
+		dur, err := time.ParseDuration(config.ImagePullTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse 'image_pull_timeout' duration: %v", err)
+		}
+		config.imagePullTimeoutDuration = dur
+	}
+	allow, err := parseImageRules(config.AllowedImages)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'allowed_images': %v", err)
+	}
+	config.imageAllow = allow
+	deny, err := parseImageRules(config.DeniedImages)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'denied_images': %v", err)
+	}
+	config.imageDeny = deny
+
+	if config.Verify != "" {
+		if err := validateVerifyPolicy(config.Verify); err != nil {
+			return err
+		}
+	}
+	if config.ImagePullRetries < 0 {
+		return fmt.Errorf("'image_pull_retries' must not be negative")
+	}
+	if config.GC.ImageDelay != "" {
+		dur, err := time.ParseDuration(config.GC.ImageDelay)
+		if err != nil {
+			return fmt.Errorf("failed to parse 'image_delay' duration: %v", err)
+		}
+		config.GC.imageDelayDuration = dur
+	}
+	if config.GC.MaxCacheSize < 0 {
+		return fmt.Errorf("'max_cache_size' must not be negative")
+	}
+
 	d.config = &config
+	d.images.setGC(d.imageGCConfig())
 	if cfg.AgentConfig != nil {
 		d.nomadConfig = cfg.AgentConfig.Driver
 	}
@@ -246,34 +480,84 @@ func (d *Driver) handleFingerprint(ctx context.Context, ch chan<- *drivers.Finge
 }
 
 func (d *Driver) buildFingerprint() *drivers.Fingerprint {
-	var health drivers.HealthState
-	var desc string
-	attrs := map[string]*pstructs.Attribute{}
+	fp := &drivers.Fingerprint{
+		Attributes:        map[string]*pstructs.Attribute{},
+		Health:            drivers.HealthStateHealthy,
+		HealthDescription: "healthy",
+	}
+	attrs := fp.Attributes
 
-	singularityVersion := useragent.Value()
+	if !d.config.Enabled {
+		fp.Health = drivers.HealthStateUndetected
+		fp.HealthDescription = "disabled"
+		return fp
+	}
 
-	if d.config.Enabled && singularityVersion != "" {
-		health = drivers.HealthStateHealthy
-		desc = "healthy"
-		attrs["driver.singularity"] = pstructs.NewBoolAttribute(true)
-		attrs["driver.singularity.version"] = pstructs.NewStringAttribute(singularityVersion)
-	} else {
-		health = drivers.HealthStateUndetected
-		desc = "disabled"
+	bin, err := d.runtimeBinary("")
+	if err != nil {
+		fp.Health = drivers.HealthStateUnhealthy
+		fp.HealthDescription = err.Error()
+		return fp
 	}
+	info, err := d.probeRuntime(bin)
+	if err != nil {
+		fp.Health = drivers.HealthStateUnhealthy
+		fp.HealthDescription = fmt.Sprintf("singularity binary is not working: %v", err)
+		return fp
+	}
+
+	attrs["driver.singularity"] = pstructs.NewBoolAttribute(true)
+	runtimeAttributes(attrs, "driver.singularity", info)
+
+	userns := userNamespacesEnabled()
+	attrs["driver.singularity.userns"] = pstructs.NewBoolAttribute(userns)
+	attrs["driver.singularity.fakeroot"] = pstructs.NewBoolAttribute(userns && subordinateIDsConfigured())
+
+	d.fingerprintRuntimes(attrs)
 
 	if d.config.AllowVolumes {
 		attrs["driver.singularity.volumes.enabled"] = pstructs.NewBoolAttribute(true)
 	}
 
-	return &drivers.Fingerprint{
-		Attributes:        attrs,
-		Health:            health,
-		HealthDescription: desc,
+	if !d.config.NoCgroups {
+		if mounts, err := d.detectCgroups(); err != nil {
+			d.logger.Warn("failed to detect cgroups, task resources will not be enforced", "error", err)
+		} else {
+			attrs["driver.singularity.cgroups.version"] = pstructs.NewIntAttribute(int64(mounts.Version), "")
+		}
+	}
+
+	return fp
+}
+
+// detectCgroups finds the cgroup hierarchies of the node and caches them for
+// the tasks started until the next fingerprint
+func (d *Driver) detectCgroups() (*cgroupMounts, error) {
+	mounts, err := findCgroupMounts()
+	if err != nil {
+		return nil, err
 	}
+
+	d.cgroupsLock.Lock()
+	d.cgroups = mounts
+	d.cgroupsLock.Unlock()
+	return mounts, nil
 }
 
-// RecoverTask try to recover a failed task, if not return error
+// cgroupMounts returns the cgroup hierarchies detected by the fingerprint,
+// detecting them if no fingerprint ran yet
+func (d *Driver) cgroupMounts() (*cgroupMounts, error) {
+	d.cgroupsLock.Lock()
+	mounts := d.cgroups
+	d.cgroupsLock.Unlock()
+
+	if mounts != nil {
+		return mounts, nil
+	}
+	return d.detectCgroups()
+}
+
+// RecoverTask reattaches to a task still running after a plugin restart
 func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 	if handle == nil {
 		return fmt.Errorf("error: handle cannot be nil")
@@ -288,32 +572,74 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 		return fmt.Errorf("failed to decode task state from handle: %v", err)
 	}
 
-	var driverConfig TaskConfig
-	if err := taskState.TaskConfig.DecodeDriverConfig(&driverConfig); err != nil {
-		return fmt.Errorf("failed to decode driver config: %v", err)
+	// the driver config isn't persisted with the task state, reattaching
+	// only needs the state
+	se := &syexec{
+		cfg:      handle.Config,
+		cachedir: d.cacheDir(),
+		logger:   d.logger,
+	}
+	if len(taskState.CgroupPaths) != 0 {
+		se.cgroup = &taskCgroup{
+			Version: taskState.CgroupVersion,
+			Paths:   taskState.CgroupPaths,
+		}
+		// COMPAT: tasks started before cgroup v2 was supported don't
+		// record the version of their cgroup
+		if se.cgroup.Version == 0 {
+			se.cgroup.Version = cgroupV1
+		}
 	}
 
-	se := prepareContainer(handle.Config, driverConfig)
-	se.cachedir = d.config.SingularityCache
-
-	if err := se.startContainer(taskState.TaskConfig); err != nil {
-		return fmt.Errorf("unable to start container: %v", err)
+	// COMPAT: tasks started before containers were supervised by an
+	// executor are tracked through their pid
+	if taskState.ExecutorSocket == "" {
+		if err := se.reattach(taskState.PID, taskState.ProcStartTime); err != nil {
+			d.logger.Error("failed to reattach to container", "error", err, "task_id", handle.Config.ID)
+			return fmt.Errorf("failed to reattach to container: %v", err)
+		}
+	} else if err := se.reattachExecutor(taskState.ExecutorSocket, taskState.PID); err != nil {
+		d.logger.Error("failed to reattach to executor", "error", err, "task_id", handle.Config.ID)
+		d.destroyOrphan(se, taskState)
+		return fmt.Errorf("failed to reattach to executor: %v", err)
 	}
+	se.startTime = taskState.ProcStartTime
 
 	h := &taskHandle{
 		syexec:     se,
 		pid:        se.containerPid,
-		taskConfig: taskState.TaskConfig,
+		taskConfig: handle.Config,
 		procState:  drivers.TaskStateRunning,
-		startedAt:  time.Now().Round(time.Millisecond),
+		startedAt:  taskState.StartedAt,
 		logger:     d.logger,
+		eventer:    d.eventer,
+		image:      taskState.ImagePath,
+		doneCh:     make(chan struct{}),
+	}
+	if h.image != "" {
+		d.images.retain(h.image)
 	}
-	d.tasks.Set(taskState.TaskConfig.ID, h)
+	d.tasks.Set(handle.Config.ID, h)
 
 	go h.run()
 	return nil
 }
 
+// destroyOrphan kills the container of a task whose executor is gone and
+// removes its cgroup. The container outlives its executor, and would keep
+// running next to the copy of the task nomad starts again.
+func (d *Driver) destroyOrphan(se *syexec, taskState TaskState) {
+	se.containerPid = taskState.PID
+	se.startTime = taskState.ProcStartTime
+	se.socketPath = taskState.ExecutorSocket
+	if err := se.kill(); err != nil {
+		d.logger.Warn("failed to kill orphaned container", "pid", taskState.PID, "error", err)
+	}
+	if err := se.destroy(); err != nil {
+		d.logger.Warn("failed to destroy orphaned container", "pid", taskState.PID, "error", err)
+	}
+}
+
 // StartTask setup the task exec and calls the container excecutor
 func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
 	if _, ok := d.tasks.Get(cfg.ID); ok {
@@ -329,14 +655,85 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	handle := drivers.NewTaskHandle(taskHandleVersion)
 	handle.Config = cfg
 
-	se := prepareContainer(cfg, driverConfig)
-	se.cachedir = d.config.SingularityCache
+	if err := d.checkImage(cfg.TaskDir().Dir, driverConfig.Image); err != nil {
+		return nil, nil, err
+	}
+	if err := d.validatePrivileges(cfg.TaskDir().Dir, driverConfig); err != nil {
+		return nil, nil, err
+	}
+
+	bin, err := d.runtimeBinary(driverConfig.Runtime)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := d.runtimeInfo(bin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Conf != nil {
+		if err := info.Conf.validate(cfg.TaskDir().Dir, driverConfig); err != nil {
+			return nil, nil, fmt.Errorf("task is not allowed by the singularity configuration: %v", err)
+		}
+	}
+
+	secretEnv, err := encryptionEnv(cfg, driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifyPolicy, err := d.verifyPolicy(driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the task runs the local copy of remote images
+	pullOpts, err := d.pullOptions(driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	image, err := d.resolveImage(cfg, bin, driverConfig.Image, pullOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := d.verifyTaskImage(cfg, bin, driverConfig.Image, image, verifyPolicy); err != nil {
+		d.releaseImage(driverConfig.Image, image)
+		return nil, nil, err
+	}
+	runConfig := driverConfig
+	runConfig.Image = image
+
+	se := prepareContainer(cfg, runConfig)
+	se.env = d.taskEnv(cfg, se.env)
+	se.bin = bin
+	se.secretEnv = secretEnv
+	se.cachedir = d.cacheDir()
 	se.logger = d.logger
 
+	if !d.config.NoCgroups && cfg.Resources != nil && cfg.Resources.LinuxResources != nil {
+		mounts, err := d.cgroupMounts()
+		if err != nil {
+			d.releaseImage(driverConfig.Image, image)
+			return nil, nil, fmt.Errorf("failed to find cgroup mounts: %v", err)
+		}
+		limits := &cgroupLimits{
+			LinuxResources: cfg.Resources.LinuxResources,
+			PidsLimit:      d.config.PidsLimit,
+		}
+		cg, err := newTaskCgroup(mounts, cgroupName(cfg.ID), limits)
+		if err != nil {
+			d.releaseImage(driverConfig.Image, image)
+			return nil, nil, fmt.Errorf("failed to create task cgroup: %v", err)
+		}
+		se.cgroup = cg
+	}
+
 	if err := se.startContainer(cfg); err != nil {
+		if se.cgroup != nil {
+			se.cgroup.destroy()
+		}
+		d.releaseImage(driverConfig.Image, image)
 		return nil, nil, fmt.Errorf("unable to start container: %v", err)
 	}
-	d.logger.Info("singularity task deployed", "driver_cfg", hclog.Fmt("%+v", se.cmd.Args))
+	d.logger.Info("singularity task deployed", "driver_cfg", hclog.Fmt("%+v", se.argv))
 
 	h := &taskHandle{
 		syexec:     se,
@@ -345,13 +742,25 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		procState:  drivers.TaskStateRunning,
 		startedAt:  time.Now().Round(time.Millisecond),
 		logger:     d.logger,
+		eventer:    d.eventer,
+		doneCh:     make(chan struct{}),
+	}
+	if needsPull(driverConfig.Image) {
+		h.image = image
 	}
 
 	driverState := TaskState{
-		ContainerName: driverConfig.Image,
-		PID:           se.containerPid,
-		TaskConfig:    cfg,
-		StartedAt:     h.startedAt,
+		ContainerName:  driverConfig.Image,
+		PID:            se.containerPid,
+		ProcStartTime:  se.startTime,
+		ExecutorSocket: se.socketPath,
+		TaskConfig:     cfg,
+		StartedAt:      h.startedAt,
+		ImagePath:      h.image,
+	}
+	if se.cgroup != nil {
+		driverState.CgroupPaths = se.cgroup.Paths
+		driverState.CgroupVersion = se.cgroup.Version
 	}
 
 	if err := handle.SetDriverState(&driverState); err != nil {
@@ -384,24 +793,23 @@ func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.E
 	return ch, nil
 }
 
+// handleWait sends the exit result of the task on ch once it exited, unless
+// ctx is done first
 func (d *Driver) handleWait(ctx context.Context, handle *taskHandle, ch chan *drivers.ExitResult) {
 	defer close(ch)
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-d.ctx.Done():
+		return
+	case <-handle.doneCh:
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-d.ctx.Done():
-			return
-		case <-ticker.C:
-			s := handle.TaskStatus()
-			if s.State == drivers.TaskStateExited {
-				ch <- handle.exitResult
-			}
-		}
+	select {
+	case <-ctx.Done():
+	case <-d.ctx.Done():
+	case ch <- handle.ExitResult():
 	}
 }
 
@@ -412,7 +820,15 @@ func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) e
 		return drivers.ErrTaskNotFound
 	}
 
-	if err := handle.shutdown(timeout); err != nil {
+	if signal == "" {
+		signal = "SIGTERM"
+	}
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+
+	if err := handle.shutdown(sig, timeout); err != nil {
 		return fmt.Errorf("executor Shutdown failed: %v", err)
 	}
 
@@ -426,8 +842,26 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 		return drivers.ErrTaskNotFound
 	}
 
-	if handle.IsRunning() && !force {
-		return fmt.Errorf("cannot destroy running task")
+	if handle.IsRunning() {
+		if !force {
+			return fmt.Errorf("cannot destroy running task")
+		}
+		if err := handle.syexec.kill(); err != nil {
+			handle.logger.Warn("failed to kill task", "task_id", taskID, "error", err)
+		}
+		select {
+		case <-handle.doneCh:
+		case <-time.After(killWaitTimeout):
+			handle.logger.Warn("timeout waiting for killed task to exit", "task_id", taskID)
+		}
+	}
+
+	if err := handle.syexec.destroy(); err != nil {
+		handle.logger.Error("failed to destroy task", "task_id", taskID, "error", err)
+	}
+
+	if handle.image != "" {
+		d.images.release(handle.image)
 	}
 
 	d.tasks.Delete(taskID)
@@ -461,10 +895,46 @@ func (d *Driver) TaskEvents(ctx context.Context) (<-chan *drivers.TaskEvent, err
 
 // SignalTask send a specific signal to a taskID
 func (d *Driver) SignalTask(taskID string, signal string) error {
-	return fmt.Errorf("Singularity driver does not support signals")
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return drivers.ErrTaskNotFound
+	}
+
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+
+	if !handle.IsRunning() {
+		return fmt.Errorf("task %q is not running", taskID)
+	}
+
+	return handle.syexec.signal(sig)
 }
 
 // ExecTask calls a exec cmd over a running task
 func (d *Driver) ExecTask(taskID string, cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
-	return nil, fmt.Errorf("Singularity driver does not support exec")
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("error cmd must have at least one value")
+	}
+
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	if !handle.IsRunning() {
+		return nil, fmt.Errorf("task %q is not running", taskID)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(d.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(d.ctx)
+	}
+	defer cancel()
+
+	return handle.syexec.execTask(ctx, cmd)
 }
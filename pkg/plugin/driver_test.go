@@ -6,9 +6,17 @@
 package singularity
 
 import (
-	hclog "github.com/hashicorp/go-hclog"
-
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
 )
 
 func TestNewSingularityDriver(t *testing.T) {
@@ -29,3 +37,167 @@ func TestNewSingularityDriver(t *testing.T) {
 		})
 	}
 }
+
+func TestDriver_WaitTask(t *testing.T) {
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	h := &taskHandle{
+		taskConfig: &drivers.TaskConfig{ID: "task"},
+		procState:  drivers.TaskStateRunning,
+		exitResult: &drivers.ExitResult{},
+		doneCh:     make(chan struct{}),
+	}
+	d.tasks.Set("task", h)
+
+	var waiters []<-chan *drivers.ExitResult
+	for i := 0; i < 3; i++ {
+		ch, err := d.WaitTask(context.Background(), "task")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		waiters = append(waiters, ch)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, err := d.WaitTask(ctx, "task")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cancel()
+	select {
+	case res, ok := <-cancelled:
+		if ok {
+			t.Errorf("unexpected exit result %+v for a cancelled wait", res)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("cancelled wait did not return")
+	}
+
+	h.stateLock.Lock()
+	h.procState = drivers.TaskStateExited
+	h.exitResult.ExitCode = 2
+	h.stateLock.Unlock()
+	close(h.doneCh)
+
+	for _, ch := range waiters {
+		select {
+		case res := <-ch:
+			if res == nil || res.ExitCode != 2 {
+				t.Errorf("unexpected exit result %+v", res)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for exit result")
+		}
+		if _, ok := <-ch; ok {
+			t.Errorf("expected wait channel to be closed after the exit result")
+		}
+	}
+
+	if _, err := d.WaitTask(context.Background(), "unknown"); err != drivers.ErrTaskNotFound {
+		t.Errorf("expected ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestDriver_RecoverTask(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	st, err := readProcStat(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc"}
+	if err := cfg.EncodeConcreteDriverConfig(&TaskConfig{Image: "/images/lolcow.sif", Command: "run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the state goes through the same encoding as the one persisted by
+	// nomad, which drops the driver config of the task
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	handle.Config = cfg
+	state := &TaskState{
+		TaskConfig:    cfg,
+		ContainerName: "/images/lolcow.sif",
+		PID:           cmd.Process.Pid,
+		ProcStartTime: st.StartTime,
+		StartedAt:     time.Now(),
+	}
+	if err := handle.SetDriverState(state); err != nil {
+		t.Fatal(err)
+	}
+	var decoded TaskState
+	if err := handle.GetDriverState(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.PID != state.PID {
+		t.Fatalf("unexpected decoded state %+v", decoded)
+	}
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	if err := d.RecoverTask(handle); err != nil {
+		t.Fatalf("failed to recover task: %v", err)
+	}
+	status, err := d.InspectTask(cfg.ID)
+	if err != nil {
+		t.Fatalf("failed to inspect recovered task: %v", err)
+	}
+	if status.State != drivers.TaskStateRunning || status.ID != cfg.ID {
+		t.Errorf("unexpected status of recovered task %+v", status)
+	}
+}
+
+func TestDriver_RecoverTaskOrphan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the container of a task whose executor crashed
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process: %v", err)
+	}
+	defer cmd.Process.Kill()
+	waitCh := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(waitCh)
+	}()
+	st, err := readProcStat(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc"}
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	handle.Config = cfg
+	if err := handle.SetDriverState(&TaskState{
+		TaskConfig:     cfg,
+		PID:            cmd.Process.Pid,
+		ProcStartTime:  st.StartTime,
+		ExecutorSocket: filepath.Join(dir, "executor.sock"),
+		StartedAt:      time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	if err := d.RecoverTask(handle); err == nil {
+		t.Fatalf("expected recovery without executor to fail")
+	}
+	select {
+	case <-waitCh:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected orphaned container to be killed")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected executor directory to be removed")
+	}
+}
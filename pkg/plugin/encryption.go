@@ -0,0 +1,60 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// encryptionEnv returns the environment giving singularity the key of the
+// encrypted image of the task. The key is passed in the environment of
+// singularity rather than its command line, so that it is never logged nor
+// persisted with the task state.
+func encryptionEnv(cfg *drivers.TaskConfig, taskCfg TaskConfig) ([]string, error) {
+	if taskCfg.PemPath != "" && taskCfg.PassphraseEnv != "" {
+		return nil, fmt.Errorf("pem_path and passphrase_env are mutually exclusive")
+	}
+
+	if taskCfg.PemPath != "" {
+		path, err := secretPath(cfg.TaskDir().SecretsDir, taskCfg.PemPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("failed to find pem_path %s: %v", taskCfg.PemPath, err)
+		}
+		return []string{"SINGULARITY_ENCRYPTION_PEM_PATH=" + path}, nil
+	}
+
+	if taskCfg.PassphraseEnv != "" {
+		passphrase := cfg.Env[taskCfg.PassphraseEnv]
+		if passphrase == "" {
+			return nil, fmt.Errorf("passphrase_env variable %s is not set", taskCfg.PassphraseEnv)
+		}
+		return []string{"SINGULARITY_ENCRYPTION_PASSPHRASE=" + passphrase}, nil
+	}
+
+	return nil, nil
+}
+
+// secretPath resolves path relative to the secrets directory of the task,
+// which it may not escape
+func secretPath(secretsDir, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("pem_path %s must be relative to the secrets directory", path)
+	}
+	abs := filepath.Join(secretsDir, path)
+	rel, err := filepath.Rel(secretsDir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("pem_path %s is outside of the secrets directory", path)
+	}
+	return abs, nil
+}
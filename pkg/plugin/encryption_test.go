@@ -0,0 +1,74 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestEncryptionEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &drivers.TaskConfig{
+		Name:     "mooo",
+		AllocDir: dir,
+		Env:      map[string]string{"SIF_PASSPHRASE": "s3cr3t"},
+	}
+	secrets := filepath.Join(dir, cfg.Name, allocdir.TaskSecrets)
+	if err := os.MkdirAll(secrets, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(secrets, "key.pem"), []byte("KEY"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		cfg  TaskConfig
+		want []string
+		err  string
+	}{
+		{"None", TaskConfig{}, nil, ""},
+		{"PemPath", TaskConfig{PemPath: "key.pem"}, []string{"SINGULARITY_ENCRYPTION_PEM_PATH=" + filepath.Join(secrets, "key.pem")}, ""},
+		{"Passphrase", TaskConfig{PassphraseEnv: "SIF_PASSPHRASE"}, []string{"SINGULARITY_ENCRYPTION_PASSPHRASE=s3cr3t"}, ""},
+		{"MissingPem", TaskConfig{PemPath: "missing.pem"}, nil, "failed to find pem_path"},
+		{"AbsolutePem", TaskConfig{PemPath: "/etc/key.pem"}, nil, "relative to the secrets directory"},
+		{"EscapingPem", TaskConfig{PemPath: "../local/key.pem"}, nil, "outside of the secrets directory"},
+		{"MissingPassphrase", TaskConfig{PassphraseEnv: "UNSET"}, nil, "is not set"},
+		{"Both", TaskConfig{PemPath: "key.pem", PassphraseEnv: "SIF_PASSPHRASE"}, nil, "mutually exclusive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env, err := encryptionEnv(cfg, tc.cfg)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				if strings.Contains(err.Error(), "s3cr3t") {
+					t.Errorf("passphrase leaked in error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(env, tc.want) {
+				t.Errorf("expected env %v, got %v", tc.want, env)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// nsenterBIN is the binary used to run commands inside a container
+	nsenterBIN = "nsenter"
+)
+
+// nsenterNamespaces lists the namespaces a command may have to join, along
+// with the matching nsenter flag
+var nsenterNamespaces = []struct {
+	name string
+	flag string
+}{
+	{"user", "--user"},
+	{"mnt", "--mount"},
+	{"uts", "--uts"},
+	{"ipc", "--ipc"},
+	{"net", "--net"},
+	{"pid", "--pid"},
+	{"cgroup", "--cgroup"},
+}
+
+// containerProcess returns the first process of the container started by the
+// singularity process pid. The singularity starter stays in the host mount
+// namespace while the containerized process runs in its own.
+func containerProcess(pid int) (int, error) {
+	hostMnt, err := procNamespace(pid, "mnt")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read mount namespace of %d: %v", pid, err)
+	}
+
+	tree, err := processTree(pid)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range tree {
+		if mnt, err := procNamespace(p, "mnt"); err == nil && mnt != hostMnt {
+			return p, nil
+		}
+	}
+
+	return pid, nil
+}
+
+// execCommand returns a command running argv inside the namespaces of the
+// container, with the environment of the containerized process.
+func (s *syexec) execCommand(argv []string) (*exec.Cmd, error) {
+	bin, err := exec.LookPath(nsenterBIN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s: %v", nsenterBIN, err)
+	}
+
+	target, err := containerProcess(s.containerPid)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"--target", strconv.Itoa(target)}
+	for _, ns := range nsenterNamespaces {
+		own, err := procNamespace(0, ns.name)
+		if err != nil {
+			// namespace not supported by the kernel
+			continue
+		}
+		theirs, err := procNamespace(target, ns.name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s namespace of %d: %v", ns.name, target, err)
+		}
+		if own != theirs {
+			args = append(args, ns.flag)
+		}
+	}
+	args = append(args, "--root", "--wd", "--")
+	args = append(args, argv...)
+
+	environ, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(target), "environ"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container environment: %v", err)
+	}
+
+	cmd := exec.Command(bin, args...)
+	cmd.Env = strings.Split(strings.TrimRight(string(environ), "\x00"), "\x00")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd, nil
+}
+
+// execTask runs argv inside the container and collects its output. The
+// command and its children are killed if ctx is done before it exits.
+func (s *syexec) execTask(ctx context.Context, argv []string) (*drivers.ExecTaskResult, error) {
+	cmd, err := s.execCommand(argv)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to exec into container: %v", err)
+	}
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-waitCh:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-waitCh
+		return nil, fmt.Errorf("failed to exec into container: %v", ctx.Err())
+	}
+
+	result := &drivers.ExitResult{}
+	if err != nil {
+		exitError, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, fmt.Errorf("failed to exec into container: %v", err)
+		}
+		ws := exitError.Sys().(syscall.WaitStatus)
+		result.ExitCode = ws.ExitStatus()
+		if ws.Signaled() {
+			result.Signal = int(ws.Signal())
+			result.ExitCode = 128 + result.Signal
+		}
+	}
+
+	return &drivers.ExecTaskResult{
+		Stdout:     stdout.Bytes(),
+		Stderr:     stderr.Bytes(),
+		ExitResult: result,
+	}, nil
+}
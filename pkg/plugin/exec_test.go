@@ -0,0 +1,121 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestContainerProcess(t *testing.T) {
+	// the test process shares the mount namespace of all its children
+	pid, err := containerProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("got pid %d, want %d", pid, os.Getpid())
+	}
+}
+
+// testContainer starts a process standing for the container of a task,
+// sharing the namespaces of the test
+func testContainer(t *testing.T) (*syexec, func()) {
+	if _, err := exec.LookPath(nsenterBIN); err != nil {
+		t.Skipf("%s not found", nsenterBIN)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root")
+	}
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start container: %v", err)
+	}
+	s := &syexec{containerPid: cmd.Process.Pid, logger: hclog.NewNullLogger()}
+	return s, func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+func TestSyexec_ExecTask(t *testing.T) {
+	s, cleanup := testContainer(t)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		name     string
+		script   string
+		stdout   string
+		stderr   string
+		exitCode int
+		signal   int
+	}{
+		{"success", "echo out", "out\n", "", 0, 0},
+		{"failure", "echo out; echo err >&2; exit 3", "out\n", "err\n", 3, 0},
+		{"signaled", "kill -TERM $$", "", "", 128 + int(syscall.SIGTERM), int(syscall.SIGTERM)},
+	} {
+		res, err := s.execTask(context.Background(), []string{"/bin/sh", "-c", tc.script})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if string(res.Stdout) != tc.stdout || string(res.Stderr) != tc.stderr {
+			t.Errorf("%s: got output %q/%q, want %q/%q", tc.name, res.Stdout, res.Stderr, tc.stdout, tc.stderr)
+		}
+		if res.ExitResult.ExitCode != tc.exitCode || res.ExitResult.Signal != tc.signal {
+			t.Errorf("%s: got exit %+v, want code %d and signal %d", tc.name, res.ExitResult, tc.exitCode, tc.signal)
+		}
+	}
+}
+
+func TestSyexec_ExecTaskTimeout(t *testing.T) {
+	s, cleanup := testContainer(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+
+	// the command leaves a child behind, which must be killed along with it
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	script := fmt.Sprintf("sleep 60 & echo $! > %s; wait", pidFile)
+	if _, err := s.execTask(ctx, []string{"/bin/sh", "-c", script}); err == nil {
+		t.Fatalf("expected command outliving the deadline to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("command killed after %v", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("failed to read pid of the child: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if st, err := readProcStat(pid); err == nil && st.State != "Z" && st.State != "X" {
+		t.Errorf("child %d of the command still running", pid)
+	}
+}
@@ -10,16 +10,27 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/plugins/drivers"
 )
 
+const (
+	// killWaitTimeout is how long shutdown waits for a killed task to exit
+	killWaitTimeout = 5 * time.Second
+)
+
 type taskHandle struct {
-	syexec syexec
-	pid    int
-	logger hclog.Logger
+	syexec  *syexec
+	pid     int
+	logger  hclog.Logger
+	eventer *eventer.Eventer
+
+	// image is the cached image the task holds a reference to
+	image string
 
 	// stateLock syncs access to all fields below
 	stateLock sync.RWMutex
@@ -29,6 +40,9 @@ type taskHandle struct {
 	startedAt   time.Time
 	completedAt time.Time
 	exitResult  *drivers.ExitResult
+
+	// doneCh is closed once the process exited and its exit result is set
+	doneCh chan struct{}
 }
 
 func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
@@ -54,52 +68,138 @@ func (h *taskHandle) IsRunning() bool {
 	return h.procState == drivers.TaskStateRunning
 }
 
+// ExitResult returns a copy of the exit result of the task
+func (h *taskHandle) ExitResult() *drivers.ExitResult {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.exitResult.Copy()
+}
+
 func (h *taskHandle) run() {
+	defer close(h.doneCh)
 	h.stateLock.Lock()
 	if h.exitResult == nil {
 		h.exitResult = &drivers.ExitResult{}
 	}
 	h.stateLock.Unlock()
 
+	// Block until process exits
+	ps := h.syexec.wait()
+	oom := h.syexec.ExitError == nil && h.oomKilled()
+
 	h.stateLock.Lock()
 	defer h.stateLock.Unlock()
 
 	if h.syexec.ExitError != nil {
 		h.exitResult.Err = h.syexec.ExitError
 		h.procState = drivers.TaskStateUnknown
-		h.completedAt = time.Now()
+		h.completedAt = ps.Time
 		return
 	}
 	h.procState = drivers.TaskStateExited
-	h.exitResult.ExitCode = h.syexec.exitCode
-	h.exitResult.Signal = 0
-	h.completedAt = time.Now()
+	h.exitResult.ExitCode = ps.ExitCode
+	h.exitResult.Signal = ps.Signal
+	h.exitResult.OOMKilled = oom
+	h.completedAt = ps.Time
+}
+
+// oomKilled checks the task cgroup for oom kills and emits a task event when
+// the task ran out of memory
+func (h *taskHandle) oomKilled() bool {
+	if h.syexec.cgroup == nil {
+		return false
+	}
+
+	oom, err := h.syexec.cgroup.oomKilled()
+	if err != nil {
+		h.logger.Warn("failed to check task for oom kills", "task_id", h.taskConfig.ID, "error", err)
+		return false
+	}
+	if !oom {
+		return false
+	}
+
+	h.logger.Warn("task was oom killed", "task_id", h.taskConfig.ID)
+	if h.eventer != nil {
+		h.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    h.taskConfig.ID,
+			TaskName:  h.taskConfig.Name,
+			AllocID:   h.taskConfig.AllocID,
+			Timestamp: time.Now(),
+			Message:   "OOM Killed",
+		})
+	}
+	return true
 }
 
 func (h *taskHandle) stats(ctx context.Context, interval time.Duration) (<-chan *drivers.TaskResourceUsage, error) {
 	ch := make(chan *drivers.TaskResourceUsage)
+	go h.handleStats(ctx, ch, interval)
 
 	return ch, nil
 }
 
-// shutdown shuts down the container, with `timeout` grace period
-// before killing the container with SIGKILL.
-func (h *taskHandle) shutdown(timeout time.Duration) error {
-	// Wait for the process to finish or kill it after a timeout (whichever happens first):
-	done := make(chan error, 1)
-	go func() {
-		done <- h.syexec.cmd.Wait()
-	}()
-	select {
-	case <-time.After(timeout * time.Second):
-		if err := h.syexec.cmd.Process.Kill(); err != nil {
-			return fmt.Errorf("failed to kill process: %v ", err)
+// handleStats samples the task resource usage every interval until ctx is
+// done
+func (h *taskHandle) handleStats(ctx context.Context, ch chan<- *drivers.TaskResourceUsage, interval time.Duration) {
+	defer close(ch)
+
+	collector := newStatsCollector(h.pid, h.syexec.startTime, h.syexec.cgroup)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(interval)
 		}
-	case err := <-done:
+
+		usage, err := collector.collect()
 		if err != nil {
-			return fmt.Errorf("process finished with error = %v", err)
+			h.logger.Debug("failed to collect task stats", "task_id", h.taskConfig.ID, "error", err)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- usage:
 		}
 	}
+}
+
+// shutdown sends sig to the container process group and waits up to timeout
+// for it to exit before killing its whole process tree. It returns once the
+// exit status of the task is known.
+func (h *taskHandle) shutdown(sig syscall.Signal, timeout time.Duration) error {
+	if !h.IsRunning() {
+		return nil
+	}
+
+	// the process may have exited in the meantime
+	if !h.syexec.alive() {
+		h.logger.Debug("task process already exited", "task_id", h.taskConfig.ID)
+	} else if err := h.syexec.signalGroup(sig); err != nil {
+		h.logger.Debug("failed to signal task", "task_id", h.taskConfig.ID, "signal", sig, "error", err)
+	}
+
+	select {
+	case <-h.doneCh:
+		return nil
+	case <-time.After(timeout):
+	}
 
+	h.logger.Warn("task did not exit before its kill timeout, killing it", "task_id", h.taskConfig.ID, "timeout", timeout)
+	if err := h.syexec.kill(); err != nil {
+		return fmt.Errorf("failed to kill process: %v", err)
+	}
+
+	select {
+	case <-h.doneCh:
+	case <-time.After(killWaitTimeout):
+		return fmt.Errorf("timeout waiting for killed task to exit")
+	}
 	return nil
 }
@@ -0,0 +1,338 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// imagesDir is the directory of the singularity cache holding the SIF
+	// images pulled by the driver
+	imagesDir = "nomad-images"
+
+	// defaultCacheDir is the directory of the user cache holding the images
+	// pulled by the driver when singularity_cache is not set
+	defaultCacheDir = "nomad-singularity"
+
+	// defaultImagePullTimeout bounds each attempt to pull an image when no
+	// image_pull_timeout is set
+	defaultImagePullTimeout = 5 * time.Minute
+
+	// imagePullBackoffLimit caps the delay between the retries of a pull
+	imagePullBackoffLimit = time.Minute
+)
+
+// imagePullBackoff is the delay before the first retry of a failed pull, it
+// doubles on each retry
+var imagePullBackoff = 2 * time.Second
+
+// permanentPullErrors are the messages singularity reports when an image
+// doesn't exist or access to it is refused, retrying such pulls is pointless
+var permanentPullErrors = []string{
+	"not found",
+	"does not exist",
+	"manifest unknown",
+	"unauthorized",
+	"authentication required",
+	"access denied",
+	"forbidden",
+}
+
+// pullSchemes lists the image transports resolved into a local SIF before
+// running a task, other images are given to singularity as is
+var pullSchemes = map[string]struct{}{
+	"library": {},
+	"docker":  {},
+	"oras":    {},
+	"shub":    {},
+	"http":    {},
+	"https":   {},
+}
+
+// pullOptions configures the pulls of a task image
+type pullOptions struct {
+	// timeout bounds each attempt to pull the image
+	timeout time.Duration
+
+	// auth holds the credentials of the pull, nil for anonymous pulls
+	auth *registryAuth
+}
+
+// imageScheme returns the transport of an image uri, which is empty for
+// local paths
+func imageScheme(uri string) string {
+	i := strings.Index(uri, "://")
+	if i < 0 {
+		return ""
+	}
+	return uri[:i]
+}
+
+// needsPull returns true if the image must be pulled before running a task
+func needsPull(uri string) bool {
+	_, ok := pullSchemes[imageScheme(uri)]
+	return ok
+}
+
+// cacheDir returns the singularity cache of the driver, empty for the default
+// cache of singularity
+func (d *Driver) cacheDir() string {
+	return d.config.SingularityCache
+}
+
+// imageDir returns the directory of the images pulled by the driver, in the
+// singularity cache when set or else in the cache of the user running the
+// plugin, which unlike the temporary directory other users can't write to
+func (d *Driver) imageDir() string {
+	if d.config.SingularityCache != "" {
+		return filepath.Join(d.config.SingularityCache, imagesDir)
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, defaultCacheDir, imagesDir)
+}
+
+// checkImageDir creates the image directory dir if needed and returns an
+// error unless it is owned by the plugin and writable by no one else, as any
+// image found there is run
+func checkImageDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create image cache: %v", err)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check image cache: %v", err)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Geteuid() || fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("image cache %s must be a directory owned by uid %d and not writable by other users", dir, os.Geteuid())
+	}
+	return nil
+}
+
+// imageID returns the name identifying the SIFs an image uri is pulled to
+func imageID(uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	return hex.EncodeToString(sum[:])
+}
+
+// imagePath returns the path of the SIF an image uri is pulled to with auth.
+// Images pulled with credentials are cached apart for each identity, so that
+// tasks without the credentials never run them and pulls with different
+// credentials are never shared. A task reuses the image cached for its
+// identity without authenticating against the registry again.
+func (d *Driver) imagePath(uri string, auth *registryAuth) string {
+	name := imageID(uri)
+	if id := auth.identity(uri); id != "" {
+		name += "-" + id
+	}
+	return filepath.Join(d.imageDir(), name+".sif")
+}
+
+// imageGCConfig returns the garbage collection configuration of the cached
+// images
+func (d *Driver) imageGCConfig() imageGCConfig {
+	keep := make(map[string]struct{}, len(d.config.GC.Keep))
+	for _, uri := range d.config.GC.Keep {
+		keep[imageID(uri)] = struct{}{}
+	}
+	return imageGCConfig{
+		enabled:      d.config.GC.Image,
+		delay:        d.config.GC.imageDelayDuration,
+		dir:          d.imageDir(),
+		maxCacheSize: d.config.GC.MaxCacheSize,
+		keep:         keep,
+	}
+}
+
+// imagePullTimeout returns the timeout of the image pulls of the task cfg
+func (d *Driver) imagePullTimeout(cfg TaskConfig) (time.Duration, error) {
+	if cfg.ImagePullTimeout != "" {
+		dur, err := time.ParseDuration(cfg.ImagePullTimeout)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse 'image_pull_timeout' duration: %v", err)
+		}
+		return dur, nil
+	}
+	if d.config.imagePullTimeoutDuration > 0 {
+		return d.config.imagePullTimeoutDuration, nil
+	}
+	return defaultImagePullTimeout, nil
+}
+
+// pullOptions returns the options of the image pulls of the task cfg
+func (d *Driver) pullOptions(cfg TaskConfig) (pullOptions, error) {
+	timeout, err := d.imagePullTimeout(cfg)
+	if err != nil {
+		return pullOptions{}, err
+	}
+	if !needsPull(cfg.Image) {
+		return pullOptions{timeout: timeout}, nil
+	}
+	auth, err := d.pullAuth(cfg.Image, cfg.Auth)
+	if err != nil {
+		return pullOptions{}, fmt.Errorf("failed to get credentials of image %s: %v", cfg.Image, err)
+	}
+	return pullOptions{timeout: timeout, auth: auth}, nil
+}
+
+// emitEvent emits a task event for the task cfg
+func (d *Driver) emitEvent(cfg *drivers.TaskConfig, message string, annotations map[string]string) {
+	d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		TaskName:    cfg.Name,
+		AllocID:     cfg.AllocID,
+		Timestamp:   time.Now(),
+		Message:     message,
+		Annotations: annotations,
+	})
+}
+
+// resolveImage returns the local image the task cfg runs. Remote images are
+// pulled into the cache unless already there, and a reference to them is held
+// for the task until it is released with releaseImage.
+func (d *Driver) resolveImage(cfg *drivers.TaskConfig, bin, uri string, opts pullOptions) (string, error) {
+	if !needsPull(uri) {
+		return uri, nil
+	}
+
+	path := d.imagePath(uri, opts.auth)
+	if err := checkImageDir(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	err := d.images.acquire(path, func() error {
+		if _, err := os.Stat(path); err == nil {
+			d.logger.Debug("image found in cache", "image", uri, "path", path)
+			return nil
+		}
+
+		annotations := map[string]string{"image": uri}
+		d.emitEvent(cfg, "Downloading image", annotations)
+		start := time.Now()
+
+		if err := d.pullImageRetry(cfg, bin, uri, path, opts); err != nil {
+			return err
+		}
+
+		d.logger.Info("pulled image", "image", uri, "path", path, "duration", time.Since(start))
+		d.emitEvent(cfg, "Downloaded image", annotations)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// releaseImage drops the reference held by a task on the image uri resolved
+// to path
+func (d *Driver) releaseImage(uri, path string) {
+	if needsPull(uri) {
+		d.images.release(path)
+	}
+}
+
+// pullImageRetry pulls the image uri to the SIF path, retrying transient
+// failures with an exponential backoff. The error returned is recoverable
+// unless the image doesn't exist or access to it is refused.
+func (d *Driver) pullImageRetry(cfg *drivers.TaskConfig, bin, uri, path string, opts pullOptions) error {
+	backoff := imagePullBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(d.ctx, opts.timeout)
+		err := d.pullImage(ctx, bin, uri, path, opts.auth)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if timedOut {
+			err = fmt.Errorf("failed to pull image %s: timeout after %s", uri, opts.timeout)
+		} else if permanentPullError(err) {
+			return structs.NewRecoverableError(err, false)
+		}
+		if attempt > d.config.ImagePullRetries || d.ctx.Err() != nil {
+			return structs.NewRecoverableError(err, true)
+		}
+
+		d.logger.Warn("failed to pull image, retrying", "image", uri, "attempt", attempt, "backoff", backoff, "error", err)
+		d.emitEvent(cfg, fmt.Sprintf("Failed to pull image, retrying in %s", backoff), map[string]string{
+			"image":   uri,
+			"attempt": strconv.Itoa(attempt),
+			"error":   err.Error(),
+		})
+
+		select {
+		case <-time.After(backoff):
+		case <-d.ctx.Done():
+			return structs.NewRecoverableError(err, true)
+		}
+		backoff *= 2
+		if backoff > imagePullBackoffLimit {
+			backoff = imagePullBackoffLimit
+		}
+	}
+}
+
+// permanentPullError returns true if err reports an image which doesn't
+// exist or can't be accessed
+func permanentPullError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, m := range permanentPullErrors {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullImage pulls the image uri to the SIF path. The image is pulled in a
+// temporary directory then moved in place, so that a partial download is
+// never mistaken for a cached image. The credentials in auth are passed in
+// the environment of singularity.
+func (d *Driver) pullImage(ctx context.Context, bin, uri, path string, auth *registryAuth) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create image cache: %v", err)
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(path), "pull")
+	if err != nil {
+		return fmt.Errorf("failed to create image cache: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	sif := filepath.Join(tmp, "image.sif")
+	cmd := exec.CommandContext(ctx, bin, "pull", sif, uri)
+	cmd.Env = os.Environ()
+	if d.cacheDir() != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SINGULARITY_CACHEDIR=%s", d.cacheDir()))
+	}
+	cmd.Env = append(cmd.Env, auth.env()...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to pull image %s: %v: %s", uri, err, strings.TrimSpace(string(out)))
+	}
+
+	if err := os.Rename(sif, path); err != nil {
+		return fmt.Errorf("failed to move image %s to the cache: %v", uri, err)
+	}
+	return nil
+}
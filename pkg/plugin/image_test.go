@@ -0,0 +1,300 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestNeedsPull(t *testing.T) {
+	for uri, want := range map[string]bool{
+		"library://sylabsed/examples/lolcow:latest": true,
+		"docker://alpine:3.9":                       true,
+		"oras://registry/image:tag":                 true,
+		"shub://vsoch/hello-world":                  true,
+		"https://example.com/image.sif":             true,
+		"/images/lolcow.sif":                        false,
+		"lolcow.sif":                                false,
+		"docker-daemon://alpine:3.9":                false,
+	} {
+		if got := needsPull(uri); got != want {
+			t.Errorf("needsPull(%q) = %v, want %v", uri, got, want)
+		}
+	}
+}
+
+func TestDriver_ResolveImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := fakeRuntime(t, dir, "singularity version 3.1.1")
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.SingularityCache = filepath.Join(dir, "cache")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	taskEvents, err := d.TaskEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the eventer drops events which are not consumed right away
+	events := make(chan *drivers.TaskEvent, 10)
+	go func() {
+		for ev := range taskEvents {
+			events <- ev
+		}
+	}()
+
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc"}
+	if path, err := d.resolveImage(cfg, bin, "/images/lolcow.sif", pullOptions{timeout: time.Minute}); err != nil || path != "/images/lolcow.sif" {
+		t.Errorf("unexpected local image path %q: %v", path, err)
+	}
+
+	uri := "library://sylabsed/examples/lolcow:latest"
+	path, err := d.resolveImage(cfg, bin, uri, pullOptions{timeout: time.Minute})
+	if err != nil {
+		t.Fatalf("failed to resolve image: %v", err)
+	}
+	if path != d.imagePath(uri, nil) || !strings.HasPrefix(path, d.config.SingularityCache) {
+		t.Errorf("unexpected image path %q", path)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || strings.TrimSpace(string(data)) != "SIF" {
+		t.Errorf("unexpected image content %q: %v", data, err)
+	}
+
+	for _, want := range []string{"Downloading image", "Downloaded image"} {
+		select {
+		case ev := <-events:
+			if ev.Message != want || ev.TaskID != cfg.ID || ev.Annotations["image"] != uri {
+				t.Errorf("unexpected event %+v, want %q", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q event", want)
+		}
+	}
+
+	// the second start is served from the cache
+	if _, err := d.resolveImage(cfg, bin, uri, pullOptions{timeout: time.Minute}); err != nil {
+		t.Fatalf("failed to resolve cached image: %v", err)
+	}
+	pulls, _ := ioutil.ReadFile(filepath.Join(dir, "pulls"))
+	if n := strings.Count(string(pulls), "\n"); n != 1 {
+		t.Errorf("expected a single pull, got %d", n)
+	}
+}
+
+// failingRuntime writes a runtime whose pulls fail with message until they
+// were attempted failures times
+func failingRuntime(t *testing.T, dir string, failures int, message string) string {
+	attempts := filepath.Join(dir, "attempts")
+	script := `#!/bin/sh
+echo x >> ` + attempts + `
+if [ $(wc -l < ` + attempts + `) -le ` + strconv.Itoa(failures) + ` ]; then
+	echo "FATAL: ` + message + `" >&2
+	exit 255
+fi
+echo SIF > "$2"
+`
+	bin := filepath.Join(dir, "singularity")
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake runtime: %v", err)
+	}
+	return bin
+}
+
+func TestCheckImageDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	images := filepath.Join(dir, "cache", imagesDir)
+	if err := checkImageDir(images); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi, err := os.Stat(images); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("expected image cache to be created private, got %v: %v", fi.Mode(), err)
+	}
+
+	// any user could plant images in a world writable cache
+	if err := os.Chmod(images, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkImageDir(images); err == nil {
+		t.Errorf("expected world writable image cache to be refused")
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Chmod(images, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(images, 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkImageDir(images); err == nil {
+			t.Errorf("expected image cache of another user to be refused")
+		}
+	}
+}
+
+func TestDriver_PullImageRetry(t *testing.T) {
+	defer func(backoff time.Duration) { imagePullBackoff = backoff }(imagePullBackoff)
+	imagePullBackoff = 10 * time.Millisecond
+
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc"}
+	uri := "docker://alpine:3.9"
+
+	for _, tc := range []struct {
+		name        string
+		failures    int
+		message     string
+		attempts    int
+		err         bool
+		recoverable bool
+	}{
+		{"Transient", 2, "connection reset by peer", 3, false, false},
+		{"RetriesExhausted", 10, "connection reset by peer", 4, true, true},
+		{"NotFound", 10, "manifest unknown", 1, true, false},
+		{"Unauthorized", 10, "unauthorized: authentication required", 1, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pull-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			bin := failingRuntime(t, dir, tc.failures, tc.message)
+
+			d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+			d.config.SingularityCache = filepath.Join(dir, "cache")
+			d.config.ImagePullRetries = 3
+
+			err = d.pullImageRetry(cfg, bin, uri, d.imagePath(uri, nil), pullOptions{timeout: time.Minute})
+			if tc.err != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tc.message) {
+					t.Errorf("expected error to report %q, got %v", tc.message, err)
+				}
+				if structs.IsRecoverable(err) != tc.recoverable {
+					t.Errorf("expected recoverable=%v, got %v", tc.recoverable, err)
+				}
+			}
+
+			data, _ := ioutil.ReadFile(filepath.Join(dir, "attempts"))
+			if n := strings.Count(string(data), "\n"); n != tc.attempts {
+				t.Errorf("expected %d attempts, got %d", tc.attempts, n)
+			}
+		})
+	}
+}
+
+func TestDriver_PullImageTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pull-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "singularity")
+	if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.SingularityCache = filepath.Join(dir, "cache")
+
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc"}
+	uri := "docker://alpine:3.9"
+	err = d.pullImageRetry(cfg, bin, uri, d.imagePath(uri, nil), pullOptions{timeout: 100 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if !structs.IsRecoverable(err) {
+		t.Errorf("expected timeout to be recoverable")
+	}
+}
+
+func TestDriver_ImagePullTimeout(t *testing.T) {
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	if timeout, err := d.imagePullTimeout(TaskConfig{}); err != nil || timeout != defaultImagePullTimeout {
+		t.Errorf("unexpected default timeout %s: %v", timeout, err)
+	}
+
+	d.config.imagePullTimeoutDuration = time.Minute
+	if timeout, err := d.imagePullTimeout(TaskConfig{}); err != nil || timeout != time.Minute {
+		t.Errorf("unexpected plugin timeout %s: %v", timeout, err)
+	}
+	if timeout, err := d.imagePullTimeout(TaskConfig{ImagePullTimeout: "30s"}); err != nil || timeout != 30*time.Second {
+		t.Errorf("unexpected task timeout %s: %v", timeout, err)
+	}
+	if _, err := d.imagePullTimeout(TaskConfig{ImagePullTimeout: "soon"}); err == nil {
+		t.Errorf("expected invalid timeout to fail")
+	}
+}
+
+func TestDriver_ResolveImageAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := fakeRuntime(t, dir, "singularity version 3.1.1")
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.SingularityCache = filepath.Join(dir, "cache")
+
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc"}
+	uri := "docker://registry.example.com/private/app:1.0"
+	alice := &registryAuth{username: "alice", password: "s3cr3t"}
+	bob := &registryAuth{username: "bob", password: "s3cr3t"}
+	mallory := &registryAuth{username: "alice", password: "guess"}
+
+	paths := make(map[string]bool)
+	for _, auth := range []*registryAuth{alice, nil, bob, alice, mallory} {
+		path, err := d.resolveImage(cfg, bin, uri, pullOptions{timeout: time.Minute, auth: auth})
+		if err != nil {
+			t.Fatalf("failed to resolve image: %v", err)
+		}
+		if path != d.imagePath(uri, auth) {
+			t.Errorf("unexpected image path %q", path)
+		}
+		if strings.Contains(path, "s3cr3t") {
+			t.Errorf("password leaked in image path %q", path)
+		}
+		paths[path] = true
+	}
+
+	// anonymous tasks and tasks with the wrong password never run the
+	// image pulled with credentials, and each identity pulls its own copy
+	// once
+	if len(paths) != 4 {
+		t.Errorf("expected an image per identity, got %v", paths)
+	}
+	if d.imagePath(uri, alice) == d.imagePath(uri, mallory) {
+		t.Errorf("same image path for different passwords of a user")
+	}
+	pulls, _ := ioutil.ReadFile(filepath.Join(dir, "pulls"))
+	if n := strings.Count(string(pulls), "\n"); n != 4 {
+		t.Errorf("expected 4 pulls, got %d", n)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// regexRulePrefix and schemeRulePrefix select the regex and scheme image
+	// rules, rules without a prefix are globs
+	regexRulePrefix  = "regex:"
+	schemeRulePrefix = "scheme:"
+
+	// localScheme designates local images in scheme rules
+	localScheme = "local"
+)
+
+// runtimeEnvPrefixes are the prefixes of the variables configuring singularity
+// and apptainer, which would let tasks set options the plugin restricts. The
+// SINGULARITYENV_ and APPTAINERENV_ variables passed to the container don't
+// match them.
+var runtimeEnvPrefixes = []string{"SINGULARITY_", "APPTAINER_"}
+
+// imageRule matches task images against a rule of allowed_images or
+// denied_images. A rule is either a glob where * matches any sequence of
+// characters, such as library://ourorg/*, a regular expression prefixed by
+// regex:, or an image transport prefixed by scheme:, scheme:local matching
+// local images.
+type imageRule struct {
+	rule   string
+	scheme string
+	re     *regexp.Regexp
+}
+
+// parseImageRule compiles rule
+func parseImageRule(rule string) (*imageRule, error) {
+	switch {
+	case strings.HasPrefix(rule, schemeRulePrefix):
+		scheme := strings.TrimPrefix(rule, schemeRulePrefix)
+		if scheme == "" {
+			return nil, fmt.Errorf("invalid image rule %q: missing scheme", rule)
+		}
+		return &imageRule{rule: rule, scheme: scheme}, nil
+
+	case strings.HasPrefix(rule, regexRulePrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(rule, regexRulePrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid image rule %q: %v", rule, err)
+		}
+		return &imageRule{rule: rule, re: re}, nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range rule {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return &imageRule{rule: rule, re: regexp.MustCompile(expr.String())}, nil
+}
+
+// parseImageRules compiles rules
+func parseImageRules(rules []string) ([]*imageRule, error) {
+	parsed := make([]*imageRule, 0, len(rules))
+	for _, rule := range rules {
+		r, err := parseImageRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// match returns true if the image uri matches the rule
+func (r *imageRule) match(uri string) bool {
+	if r.scheme != "" {
+		scheme := imageScheme(uri)
+		if scheme == "" {
+			scheme = localScheme
+		}
+		return scheme == r.scheme
+	}
+	return r.re.MatchString(uri)
+}
+
+// checkImage returns a non recoverable error naming the rule which refuses the
+// image uri. Denied images are refused even if they are allowed, and images
+// must match one of the allowed_images rules when there are any.
+func (d *Driver) checkImage(taskDir, uri string) error {
+	// local paths are matched as singularity opens them from the task
+	// directory, so that neither ../../x.sif, /shared/images/../x.sif nor a
+	// link escape the rules
+	if imageScheme(uri) == "" {
+		uri = hostPath(taskDir, uri)
+	}
+
+	for _, r := range d.config.imageDeny {
+		if r.match(uri) {
+			return structs.NewRecoverableError(fmt.Errorf("image %s is denied by rule %q", uri, r.rule), false)
+		}
+	}
+	if len(d.config.imageAllow) == 0 {
+		return nil
+	}
+	for _, r := range d.config.imageAllow {
+		if r.match(uri) {
+			return nil
+		}
+	}
+	return structs.NewRecoverableError(fmt.Errorf("image %s matches no allowed_images rule", uri), false)
+}
+
+// validatePrivileges returns a non recoverable error if the task asks for a
+// privilege the plugin configuration doesn't allow
+func (d *Driver) validatePrivileges(taskDir string, taskCfg TaskConfig) error {
+	if err := d.checkPrivileges(taskDir, taskCfg); err != nil {
+		return structs.NewRecoverableError(fmt.Errorf("task is not allowed by the plugin configuration: %v", err), false)
+	}
+	return nil
+}
+
+// checkPrivileges returns an error naming the first privilege of the task
+// which isn't allowed
+func (d *Driver) checkPrivileges(taskDir string, taskCfg TaskConfig) error {
+	if taskCfg.KeepPrivs && !d.config.AllowKeepPrivs {
+		return fmt.Errorf("keepprivs is disabled by allow_keepprivs")
+	}
+	if taskCfg.Fakeroot && !d.config.AllowFakeroot {
+		return fmt.Errorf("fakeroot is disabled by allow_fakeroot")
+	}
+
+	if len(d.config.AllowedSecurityOptions) != 0 {
+		for _, opt := range taskCfg.Security {
+			if !securityOptionAllowed(d.config.AllowedSecurityOptions, opt) {
+				return fmt.Errorf("security option %q is not in allowed_security_options", opt)
+			}
+		}
+	}
+
+	if len(d.config.AllowedBindSources) != 0 {
+		for _, m := range hostMounts(taskCfg) {
+			src := bindSource(taskDir, m.path)
+			if !pathAllowed(d.config.AllowedBindSources, src) {
+				return fmt.Errorf("%s source %s is not in allowed_bind_sources", m.option, src)
+			}
+		}
+	}
+	return nil
+}
+
+// restrictsPrivileges returns true if the plugin configuration restricts the
+// privileges tasks may ask for
+func (d *Driver) restrictsPrivileges() bool {
+	return !d.config.AllowKeepPrivs || !d.config.AllowFakeroot ||
+		len(d.config.AllowedSecurityOptions) != 0 || len(d.config.AllowedBindSources) != 0
+}
+
+// taskEnv returns env, the environment of the task cfg, without the variables
+// configuring the runtime when the plugin restricts privileges, as they would
+// bypass the restrictions. Dropped variables are reported in a task event.
+func (d *Driver) taskEnv(cfg *drivers.TaskConfig, env []string) []string {
+	if !d.restrictsPrivileges() {
+		return env
+	}
+
+	filtered := make([]string, 0, len(env))
+	var dropped []string
+	for _, kv := range env {
+		runtimeVar := false
+		for _, prefix := range runtimeEnvPrefixes {
+			if strings.HasPrefix(kv, prefix) {
+				runtimeVar = true
+				break
+			}
+		}
+		if runtimeVar {
+			dropped = append(dropped, strings.SplitN(kv, "=", 2)[0])
+		} else {
+			filtered = append(filtered, kv)
+		}
+	}
+
+	if len(dropped) != 0 {
+		d.logger.Warn("dropped runtime variables from the task environment", "task_id", cfg.ID, "variables", dropped)
+		d.emitEvent(cfg, "Runtime variables dropped from the environment", map[string]string{
+			"variables": strings.Join(dropped, ", "),
+		})
+	}
+	return filtered
+}
+
+// hostMount is a host path mounted in the container by a task option
+type hostMount struct {
+	option string
+	path   string
+}
+
+// hostMounts returns the host paths the task mounts in the container, with
+// the syntax src[:dest[:opts]] of binds
+func hostMounts(taskCfg TaskConfig) []hostMount {
+	var mounts []hostMount
+	for _, binds := range taskCfg.Binds {
+		// a bind option may hold several comma separated binds
+		for _, bind := range strings.Split(binds, ",") {
+			mounts = append(mounts, hostMount{"bind", bind})
+		}
+	}
+	for _, overlay := range taskCfg.Overlay {
+		mounts = append(mounts, hostMount{"overlay", overlay})
+	}
+	if taskCfg.Home != "" {
+		mounts = append(mounts, hostMount{"home", taskCfg.Home})
+	}
+	if taskCfg.Workdir != "" {
+		mounts = append(mounts, hostMount{"workdir", taskCfg.Workdir})
+	}
+	return mounts
+}
+
+// securityOptionAllowed returns true if opt, such as seccomp:/profile.json or
+// uid:0, is in allowed either as is or by its type
+func securityOptionAllowed(allowed []string, opt string) bool {
+	kind := strings.SplitN(opt, ":", 2)[0]
+	for _, a := range allowed {
+		if a == opt || a == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// bindSource returns the host path of a bind, whose syntax is
+// src[:dest[:opts]]. Relative sources are resolved against the task
+// directory, where singularity runs, and symlinks are followed so that a link
+// can't point the bind out of the allowed sources.
+func bindSource(taskDir, bind string) string {
+	return hostPath(taskDir, strings.SplitN(strings.TrimSpace(bind), ":", 2)[0])
+}
+
+// hostPath returns the host path singularity opens for path from the task
+// directory, with symlinks resolved
+func hostPath(taskDir, path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(taskDir, path)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
+
+// pathAllowed returns true if path is one of the prefixes or is below one
+func pathAllowed(prefixes []string, path string) bool {
+	for _, prefix := range prefixes {
+		prefix = filepath.Clean(prefix)
+		if path == prefix || prefix == "/" || strings.HasPrefix(path, prefix+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
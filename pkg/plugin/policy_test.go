@@ -0,0 +1,229 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestImageRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule  string
+		uri   string
+		match bool
+	}{
+		{"library://ourorg/*", "library://ourorg/tools/app:1.0", true},
+		{"library://ourorg/*", "library://other/tools/app:1.0", false},
+		{"/shared/images/*.sif", "/shared/images/lolcow.sif", true},
+		{"/shared/images/*.sif", "/shared/images/lolcow.img", false},
+		{"docker://alpine:3.?", "docker://alpine:3.9", true},
+		{"regex:^docker://registry\\.example\\.com/", "docker://registry.example.com/app", true},
+		{"regex:^docker://registry\\.example\\.com/", "docker://registry.example.com.evil/app", false},
+		{"scheme:docker", "docker://alpine", true},
+		{"scheme:docker", "library://alpine", false},
+		{"scheme:local", "/shared/images/lolcow.sif", true},
+		{"scheme:local", "shub://vsoch/hello-world", false},
+	} {
+		r, err := parseImageRule(tc.rule)
+		if err != nil {
+			t.Fatalf("failed to parse rule %q: %v", tc.rule, err)
+		}
+		if got := r.match(tc.uri); got != tc.match {
+			t.Errorf("rule %q on %q: expected match=%v, got %v", tc.rule, tc.uri, tc.match, got)
+		}
+	}
+
+	for _, rule := range []string{"regex:(", "scheme:"} {
+		if _, err := parseImageRule(rule); err == nil {
+			t.Errorf("expected invalid rule %q to fail", rule)
+		}
+	}
+}
+
+func TestDriver_CheckImage(t *testing.T) {
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	if err := d.checkImage("/alloc/task", "docker://alpine"); err != nil {
+		t.Errorf("expected images to be allowed without rules: %v", err)
+	}
+
+	var err error
+	d.config.imageAllow, err = parseImageRules([]string{"library://ourorg/*", "/shared/images/*.sif"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.config.imageDeny, err = parseImageRules([]string{"library://ourorg/untrusted/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		uri string
+		err string
+	}{
+		{"library://ourorg/tools/app:1.0", ""},
+		{"/shared/images/lolcow.sif", ""},
+		{"library://ourorg/untrusted/app:1.0", `denied by rule "library://ourorg/untrusted/*"`},
+		{"docker://alpine", "matches no allowed_images rule"},
+		{"/shared/images/../../etc/lolcow.sif", "matches no allowed_images rule"},
+	} {
+		err := d.checkImage("/alloc/task", tc.uri)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.uri, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.uri, tc.err, err)
+		} else if structs.IsRecoverable(err) {
+			t.Errorf("%s: expected non recoverable error", tc.uri)
+		}
+	}
+}
+
+func TestDriver_CheckImageRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	taskDir := filepath.Join(dir, "alloc", "task")
+	for _, d := range []string{taskDir, filepath.Join(dir, "forbidden")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "forbidden", "x.sif"), []byte("sif"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "forbidden", "x.sif"), filepath.Join(taskDir, "link.sif")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.imageDeny, err = parseImageRules([]string{filepath.Join(dir, "forbidden") + "/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uri := range []string{
+		filepath.Join(dir, "forbidden", "x.sif"),
+		"../../forbidden/x.sif",
+		"link.sif",
+	} {
+		if err := d.checkImage(taskDir, uri); err == nil || !strings.Contains(err.Error(), "denied by rule") {
+			t.Errorf("%s: expected image to be denied, got %v", uri, err)
+		}
+	}
+	if err := d.checkImage(taskDir, "local/app.sif"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDriver_ValidatePrivileges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared := filepath.Join(dir, "shared")
+	if err := os.MkdirAll(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a link below an allowed source pointing out of it
+	if err := os.Symlink("/etc", filepath.Join(shared, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	taskDir := filepath.Join(dir, "task")
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.AllowedSecurityOptions = []string{"seccomp", "uid:1000"}
+	d.config.AllowedBindSources = []string{shared, taskDir}
+
+	for _, tc := range []struct {
+		name string
+		cfg  TaskConfig
+		err  string
+	}{
+		{"None", TaskConfig{}, ""},
+		{"KeepPrivs", TaskConfig{KeepPrivs: true}, "allow_keepprivs"},
+		{"Fakeroot", TaskConfig{Fakeroot: true}, "allow_fakeroot"},
+		{"SecurityType", TaskConfig{Security: []string{"seccomp:/profile.json"}}, ""},
+		{"SecurityValue", TaskConfig{Security: []string{"uid:1000"}}, ""},
+		{"SecurityDenied", TaskConfig{Security: []string{"uid:0"}}, `"uid:0" is not in allowed_security_options`},
+		{"Bind", TaskConfig{Binds: []string{shared + "/data:/data:ro"}}, ""},
+		{"RelativeBind", TaskConfig{Binds: []string{"local:/local"}}, ""},
+		{"BindDenied", TaskConfig{Binds: []string{"/etc:/host/etc"}}, "bind source /etc is not in allowed_bind_sources"},
+		{"BindList", TaskConfig{Binds: []string{shared + ":/shared,/etc:/host/etc"}}, "bind source /etc"},
+		{"BindEscape", TaskConfig{Binds: []string{shared + "/../../etc:/etc"}}, "is not in allowed_bind_sources"},
+		{"BindPrefix", TaskConfig{Binds: []string{shared + "-other:/other"}}, "is not in allowed_bind_sources"},
+		{"BindSymlink", TaskConfig{Binds: []string{shared + "/etc:/host/etc"}}, "bind source /etc"},
+		{"Home", TaskConfig{Home: shared + "/home:/home/user"}, ""},
+		{"HomeDenied", TaskConfig{Home: "/root:/home/user"}, "home source /root"},
+		{"Overlay", TaskConfig{Overlay: []string{shared + "/overlay.img:ro"}}, ""},
+		{"OverlayDenied", TaskConfig{Overlay: []string{"/var/overlay"}}, "overlay source /var/overlay"},
+		{"Workdir", TaskConfig{Workdir: "local/work"}, ""},
+		{"WorkdirDenied", TaskConfig{Workdir: "/var/tmp"}, "workdir source /var/tmp"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := d.validatePrivileges(taskDir, tc.cfg)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			} else if structs.IsRecoverable(err) {
+				t.Errorf("expected non recoverable error")
+			}
+		})
+	}
+
+	d.config.AllowKeepPrivs = true
+	d.config.AllowFakeroot = true
+	if err := d.validatePrivileges(taskDir, TaskConfig{KeepPrivs: true, Fakeroot: true}); err != nil {
+		t.Errorf("unexpected error once allowed: %v", err)
+	}
+}
+
+func TestDriver_TaskEnv(t *testing.T) {
+	env := []string{
+		"PATH=/usr/bin",
+		"SINGULARITY_BIND=/etc:/host/etc",
+		"SINGULARITY_KEEP_PRIVS=1",
+		"APPTAINER_FAKEROOT=1",
+		"SINGULARITYENV_FOO=bar",
+		"APPTAINERENV_BAZ=qux",
+	}
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc"}
+
+	// the permissive default leaves the environment untouched
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.AllowKeepPrivs = true
+	d.config.AllowFakeroot = true
+	if got := d.taskEnv(cfg, env); !reflect.DeepEqual(got, env) {
+		t.Errorf("expected env %v, got %v", env, got)
+	}
+
+	d.config.AllowedBindSources = []string{"/shared"}
+	want := []string{"PATH=/usr/bin", "SINGULARITYENV_FOO=bar", "APPTAINERENV_BAZ=qux"}
+	if got := d.taskEnv(cfg, env); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected env %v, got %v", want, got)
+	}
+}
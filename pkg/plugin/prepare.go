@@ -6,18 +6,13 @@
 package singularity
 
 import (
-	"fmt"
-	"io"
-	"io/ioutil"
-
-	"github.com/hashicorp/nomad/client/lib/fifo"
 	"github.com/hashicorp/nomad/plugins/drivers"
 )
 
 // prepareContainer preloads the taskcnf into args to be apssed to a execCmd
-func prepareContainer(cfg *drivers.TaskConfig, taskCfg TaskConfig) syexec {
+func prepareContainer(cfg *drivers.TaskConfig, taskCfg TaskConfig) *syexec {
 	argv := make([]string, 0, 50)
-	var se syexec
+	se := &syexec{}
 	se.taskConfig = taskCfg
 	se.cfg = cfg
 	se.env = cfg.EnvList()
@@ -40,6 +35,9 @@ func prepareContainer(cfg *drivers.TaskConfig, taskCfg TaskConfig) syexec {
 	if taskCfg.KeepPrivs {
 		argv = append(argv, "--keep-privs")
 	}
+	if taskCfg.Fakeroot {
+		argv = append(argv, "--fakeroot")
+	}
 	if taskCfg.DropCaps != "" {
 		argv = append(argv, "--drop-caps", taskCfg.DropCaps)
 	}
@@ -69,50 +67,3 @@ func prepareContainer(cfg *drivers.TaskConfig, taskCfg TaskConfig) syexec {
 
 	return se
 }
-
-type nopCloser struct {
-	io.Writer
-}
-
-func (nopCloser) Close() error { return nil }
-
-// Stdout returns a writer for the configured file descriptor
-func (s *syexec) Stdout() (io.WriteCloser, error) {
-	if s.stdout == nil {
-		if s.cfg.StdoutPath != "" {
-			f, err := fifo.OpenWriter(s.cfg.StdoutPath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create stdout: %v", err)
-			}
-			s.stdout = f
-		} else {
-			s.stdout = nopCloser{ioutil.Discard}
-		}
-	}
-	return s.stdout, nil
-}
-
-// Stderr returns a writer for the configured file descriptor
-func (s *syexec) Stderr() (io.WriteCloser, error) {
-	if s.stderr == nil {
-		if s.cfg.StderrPath != "" {
-			f, err := fifo.OpenWriter(s.cfg.StderrPath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create stderr: %v", err)
-			}
-			s.stderr = f
-		} else {
-			s.stderr = nopCloser{ioutil.Discard}
-		}
-	}
-	return s.stderr, nil
-}
-
-func (s *syexec) Close() {
-	if s.stdout != nil {
-		s.stdout.Close()
-	}
-	if s.stderr != nil {
-		s.stderr.Close()
-	}
-}
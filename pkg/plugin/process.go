@@ -0,0 +1,172 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// procStat holds the fields of /proc/<pid>/stat used by the driver
+type procStat struct {
+	State     string
+	PPid      int
+	UTime     uint64
+	STime     uint64
+	StartTime uint64
+	RSS       uint64
+}
+
+// readProcStat parses /proc/<pid>/stat for the given pid
+func readProcStat(pid int) (*procStat, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// the command name is wrapped in parenthesis and may contain spaces,
+	// so fields are split after the last closing one: fields[0] is the
+	// third field (state) described in proc(5)
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed stat file for pid %d", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("malformed stat file for pid %d", pid)
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ppid for pid %d: %v", pid, err)
+	}
+
+	// utime, stime, starttime and rss are the 14th, 15th, 22nd and 24th fields
+	var values [4]uint64
+	for i, idx := range []int{11, 12, 19, 21} {
+		if values[i], err = strconv.ParseUint(fields[idx], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid stat field %d for pid %d: %v", idx+3, pid, err)
+		}
+	}
+
+	return &procStat{
+		State:     fields[0],
+		PPid:      ppid,
+		UTime:     values[0],
+		STime:     values[1],
+		StartTime: values[2],
+		RSS:       values[3] * uint64(os.Getpagesize()),
+	}, nil
+}
+
+// readProcSwap returns the amount of swap used by pid in bytes
+func readProcSwap(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "VmSwap:") {
+			continue
+		}
+		// the value is expressed in kB
+		fields := strings.Fields(strings.TrimPrefix(line, "VmSwap:"))
+		if len(fields) == 0 {
+			break
+		}
+		kb, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid swap value for pid %d: %v", pid, err)
+		}
+		return kb * 1024, nil
+	}
+
+	// kernel threads don't report any memory usage
+	return 0, nil
+}
+
+// readProcCmdline returns the argv of the given pid
+func readProcCmdline(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// isProcAlive returns true if pid still refers to the process started at
+// startTime and has not exited yet.
+func isProcAlive(pid int, startTime uint64) bool {
+	st, err := readProcStat(pid)
+	if err != nil {
+		return false
+	}
+	return st.StartTime == startTime && st.State != "Z" && st.State != "X"
+}
+
+// processTree returns pid followed by all its descendants, parents are
+// always listed before their children
+func processTree(pid int) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[int][]int)
+	for _, e := range entries {
+		p, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		st, err := readProcStat(p)
+		if err != nil {
+			// the process exited while walking /proc
+			continue
+		}
+		children[st.PPid] = append(children[st.PPid], p)
+	}
+
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree, nil
+}
+
+// killProcessTree sends SIGKILL to pid and all its descendants
+func killProcessTree(pid int) error {
+	tree, err := processTree(pid)
+	if err != nil {
+		return err
+	}
+	for _, p := range tree {
+		if err := syscall.Kill(p, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to kill process %d: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// procNamespace returns the identifier of the ns namespace of pid, pid 0
+// designates the calling process
+func procNamespace(pid int, ns string) (string, error) {
+	p := "self"
+	if pid != 0 {
+		p = strconv.Itoa(pid)
+	}
+	return os.Readlink(filepath.Join("/proc", p, "ns", ns))
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestReadProcStat(t *testing.T) {
+	st, err := readProcStat(os.Getpid())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st.PPid != os.Getppid() {
+		t.Errorf("got ppid %d, want %d", st.PPid, os.Getppid())
+	}
+	if !isProcAlive(os.Getpid(), st.StartTime) {
+		t.Errorf("expected current process to be alive")
+	}
+	if isProcAlive(os.Getpid(), st.StartTime+1) {
+		t.Errorf("expected start time mismatch to be detected")
+	}
+}
+
+func TestProcessTree(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start child: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	tree, err := processTree(os.Getpid())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tree) == 0 || tree[0] != os.Getpid() {
+		t.Fatalf("expected tree to start with the current process, got %v", tree)
+	}
+
+	found := false
+	for _, pid := range tree {
+		if pid == cmd.Process.Pid {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("child %d not found in process tree %v", cmd.Process.Pid, tree)
+	}
+}
+
+func TestKillProcessTree(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 60 & sleep 60; wait")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start child: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	// wait for the shell to start both sleeps
+	var tree []int
+	for i := 0; i < 50 && len(tree) < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		var err error
+		if tree, err = processTree(cmd.Process.Pid); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(tree) < 3 {
+		t.Fatalf("expected a shell and two children, got %v", tree)
+	}
+
+	if err := killProcessTree(cmd.Process.Pid); err != nil {
+		t.Fatalf("failed to kill process tree: %v", err)
+	}
+	cmd.Wait()
+
+	// the orphaned sleeps are reaped by init, give it a chance to do so
+	for _, pid := range tree[1:] {
+		for i := 0; i < 50; i++ {
+			if st, err := readProcStat(pid); err != nil || st.State == "Z" {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if st, err := readProcStat(pid); err == nil && st.State != "Z" {
+			t.Errorf("process %d still running", pid)
+		}
+	}
+}
+
+func TestSyexec_KillRecycledPid(t *testing.T) {
+	// the container process of the task, already reaped
+	container := exec.Command("true")
+	if err := container.Run(); err != nil {
+		t.Fatalf("failed to run container: %v", err)
+	}
+
+	// an unrelated process group leader now holding the pid of the container
+	other := exec.Command("sleep", "60")
+	other.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := other.Start(); err != nil {
+		t.Fatalf("failed to start process: %v", err)
+	}
+	defer func() {
+		other.Process.Kill()
+		other.Wait()
+	}()
+	st, err := readProcStat(other.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &syexec{
+		process:      container.Process,
+		containerPid: other.Process.Pid,
+		startTime:    st.StartTime + 1,
+		logger:       hclog.NewNullLogger(),
+	}
+	if err := s.kill(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !isProcAlive(other.Process.Pid, st.StartTime) {
+		t.Fatalf("process recycling the container pid was killed")
+	}
+
+	// the same process is killed once it is the container
+	s.startTime = st.StartTime
+	if err := s.kill(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other.Wait()
+	if isProcAlive(other.Process.Pid, st.StartTime) {
+		t.Errorf("container process still running")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, level := range []string{"trace", "debug", "info", "warn", "error"} {
+		logger := hclog.New(&hclog.LoggerOptions{Level: hclog.LevelFromString(level)})
+		if got := logLevel(logger); got != level {
+			t.Errorf("logLevel() = %q, want %q", got, level)
+		}
+	}
+}
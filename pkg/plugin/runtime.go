@@ -0,0 +1,272 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+const (
+	// singularityBIN is the name of the singularity binary looked up in PATH
+	singularityBIN = "singularity"
+
+	// defaultSingularityPath is where singularity is installed from source,
+	// which is often missing from the PATH of the nomad agent
+	defaultSingularityPath = "/usr/local/bin/singularity"
+
+	// flavorSingularity and flavorApptainer are the runtime flavors reported
+	// by the fingerprint
+	flavorSingularity = "singularity"
+	flavorApptainer   = "apptainer"
+
+	// runtimeProbeTimeout bounds the commands run to fingerprint a runtime
+	runtimeProbeTimeout = 10 * time.Second
+)
+
+// runtimeInfo describes a singularity installation
+type runtimeInfo struct {
+	Path    string
+	Flavor  string
+	Version string
+
+	// Setuid is true if the runtime is installed with a setuid starter
+	Setuid bool
+
+	// BuildConfig holds the variables reported by buildcfg
+	BuildConfig map[string]string
+
+	// Conf is the configuration file of the runtime, nil if it has none
+	Conf *singularityConf
+}
+
+// findBinary resolves path, the path or the name of a singularity binary, to
+// an executable. An empty path looks singularity up in PATH, then falls back
+// to the default install location.
+func findBinary(path string) (string, error) {
+	if path != "" {
+		bin, err := exec.LookPath(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to find singularity binary %s: %v", path, err)
+		}
+		return bin, nil
+	}
+
+	if bin, err := exec.LookPath(singularityBIN); err == nil {
+		return bin, nil
+	}
+	bin, err := exec.LookPath(defaultSingularityPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to find singularity binary in PATH or at %s", defaultSingularityPath)
+	}
+	return bin, nil
+}
+
+// runtimeBinary returns the singularity binary of the named runtime, the
+// empty name designating the default one
+func (d *Driver) runtimeBinary(name string) (string, error) {
+	path := d.config.SingularityPath
+	if name != "" {
+		p, ok := d.config.Runtimes[name]
+		if !ok {
+			return "", fmt.Errorf("unknown runtime %q", name)
+		}
+		path = p
+	}
+	return findBinary(path)
+}
+
+// runtimeNames returns the sorted names of the configured runtimes
+func (d *Driver) runtimeNames() []string {
+	names := make([]string, 0, len(d.config.Runtimes))
+	for name := range d.config.Runtimes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// probeRuntime runs the singularity binary bin to gather its version and
+// build configuration
+func probeRuntime(bin string) (*runtimeInfo, error) {
+	out, err := runRuntime(bin, "--version")
+	if err != nil {
+		return nil, err
+	}
+	flavor, version, err := parseVersion(out)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = runRuntime(bin, "buildcfg")
+	if err != nil {
+		return nil, err
+	}
+	buildcfg := parseBuildConfig(out)
+
+	conf, err := loadSingularityConf(confPath(flavor, buildcfg))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return &runtimeInfo{
+		Path:        bin,
+		Flavor:      flavor,
+		Version:     version,
+		Setuid:      starterSetuid(buildcfg["LIBEXECDIR"]),
+		BuildConfig: buildcfg,
+		Conf:        conf,
+	}, nil
+}
+
+// runtimeInfo returns the description of the runtime installed at bin, as
+// gathered by the last fingerprint or probed now if it wasn't
+func (d *Driver) runtimeInfo(bin string) (*runtimeInfo, error) {
+	d.runtimesLock.Lock()
+	info, ok := d.runtimes[bin]
+	d.runtimesLock.Unlock()
+	if ok {
+		return info, nil
+	}
+	return d.probeRuntime(bin)
+}
+
+// probeRuntime probes the runtime installed at bin and caches its description
+func (d *Driver) probeRuntime(bin string) (*runtimeInfo, error) {
+	info, err := probeRuntime(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	d.runtimesLock.Lock()
+	if d.runtimes == nil {
+		d.runtimes = make(map[string]*runtimeInfo)
+	}
+	d.runtimes[bin] = info
+	d.runtimesLock.Unlock()
+	return info, nil
+}
+
+// runRuntime runs bin with args and returns its standard output
+func runRuntime(bin string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), runtimeProbeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, bin, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s %s: %v", bin, strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+// parseVersion parses the output of singularity --version, such as
+// "singularity version 3.1.1", "singularity-ce version 3.9.0" or
+// "apptainer version 1.1.0"
+func parseVersion(out string) (flavor, version string, err error) {
+	fields := strings.Fields(out)
+	if len(fields) != 3 || fields[1] != "version" {
+		return "", "", fmt.Errorf("unexpected version output %q", strings.TrimSpace(out))
+	}
+
+	flavor = flavorSingularity
+	if strings.HasPrefix(fields[0], flavorApptainer) {
+		flavor = flavorApptainer
+	}
+	return flavor, fields[2], nil
+}
+
+// parseBuildConfig parses the KEY=value lines printed by buildcfg
+func parseBuildConfig(out string) map[string]string {
+	cfg := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 {
+			cfg[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return cfg
+}
+
+// starterSetuid returns true if the starter installed under libexecdir is
+// setuid root
+func starterSetuid(libexecdir string) bool {
+	if libexecdir == "" {
+		return false
+	}
+	for _, flavor := range []string{flavorSingularity, flavorApptainer} {
+		fi, err := os.Stat(filepath.Join(libexecdir, flavor, "bin", "starter-suid"))
+		if err != nil {
+			continue
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if ok && st.Uid == 0 && fi.Mode()&os.ModeSetuid != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// userNamespacesEnabled returns true if the kernel allows the creation of
+// user namespaces
+func userNamespacesEnabled() bool {
+	data, err := ioutil.ReadFile("/proc/sys/user/max_user_namespaces")
+	if err != nil {
+		return false
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return err == nil && max > 0
+}
+
+// subordinateIDsConfigured returns true if subordinate uids are allocated to
+// users, which fakeroot requires to map the ids of a container
+func subordinateIDsConfigured() bool {
+	data, err := ioutil.ReadFile("/etc/subuid")
+	return err == nil && strings.TrimSpace(string(data)) != ""
+}
+
+// runtimeAttributes adds the attributes describing info to attrs, each named
+// after prefix
+func runtimeAttributes(attrs map[string]*pstructs.Attribute, prefix string, info *runtimeInfo) {
+	attrs[prefix+".path"] = pstructs.NewStringAttribute(info.Path)
+	attrs[prefix+".version"] = pstructs.NewStringAttribute(info.Version)
+	attrs[prefix+".flavor"] = pstructs.NewStringAttribute(info.Flavor)
+	attrs[prefix+".setuid"] = pstructs.NewBoolAttribute(info.Setuid)
+
+	if info.Conf != nil {
+		info.Conf.attributes(attrs, prefix+".conf")
+	}
+}
+
+// fingerprintRuntimes adds the attributes of each available named runtime
+// to attrs
+func (d *Driver) fingerprintRuntimes(attrs map[string]*pstructs.Attribute) {
+	for _, name := range d.runtimeNames() {
+		bin, err := d.runtimeBinary(name)
+		if err != nil {
+			d.logger.Debug("runtime is not available", "runtime", name, "error", err)
+			continue
+		}
+		info, err := d.probeRuntime(bin)
+		if err != nil {
+			d.logger.Debug("runtime is not working", "runtime", name, "error", err)
+			continue
+		}
+		runtimeAttributes(attrs, "driver.singularity.runtime."+name, info)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// fakeRuntime writes a script mimicking the version, buildcfg and pull
+// commands of a singularity binary to dir. Pulled uris are logged to the
+// pulls file of dir.
+func fakeRuntime(t *testing.T, dir, version string) string {
+	script := `#!/bin/sh
+case "$1" in
+--version) echo "` + version + `" ;;
+buildcfg) echo "PREFIX=/usr"; echo "LIBEXECDIR=` + dir + `" ;;
+pull) echo "$3" >> ` + filepath.Join(dir, "pulls") + `; echo SIF > "$2" ;;
+*) exit 1 ;;
+esac
+`
+	bin := filepath.Join(dir, "singularity")
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake runtime: %v", err)
+	}
+	return bin
+}
+
+func TestDriver_RuntimeBinary(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found in PATH")
+	}
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.SingularityPath = "sh"
+	d.config.Runtimes = map[string]string{
+		"apptainer": sh,
+		"missing":   "/nonexistent/singularity",
+	}
+
+	if bin, err := d.runtimeBinary(""); err != nil || bin != sh {
+		t.Errorf("unexpected default runtime binary %q: %v", bin, err)
+	}
+	if bin, err := d.runtimeBinary("apptainer"); err != nil || bin != sh {
+		t.Errorf("unexpected apptainer runtime binary %q: %v", bin, err)
+	}
+	if _, err := d.runtimeBinary("missing"); err == nil {
+		t.Errorf("expected an error for a missing runtime binary")
+	}
+	if _, err := d.runtimeBinary("unknown"); err == nil {
+		t.Errorf("expected an error for an unknown runtime")
+	}
+
+	if names := d.runtimeNames(); len(names) != 2 || names[0] != "apptainer" || names[1] != "missing" {
+		t.Errorf("unexpected runtime names %v", names)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		out     string
+		flavor  string
+		version string
+	}{
+		{"singularity version 3.1.1\n", flavorSingularity, "3.1.1"},
+		{"singularity-ce version 3.9.0-1.el8\n", flavorSingularity, "3.9.0-1.el8"},
+		{"apptainer version 1.1.0\n", flavorApptainer, "1.1.0"},
+	} {
+		flavor, version, err := parseVersion(tc.out)
+		if err != nil {
+			t.Errorf("parseVersion(%q) failed: %v", tc.out, err)
+			continue
+		}
+		if flavor != tc.flavor || version != tc.version {
+			t.Errorf("parseVersion(%q) = %q, %q, want %q, %q", tc.out, flavor, version, tc.flavor, tc.version)
+		}
+	}
+
+	if _, _, err := parseVersion("garbage"); err == nil {
+		t.Errorf("expected an error for an unexpected version output")
+	}
+}
+
+func TestDriver_Fingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.Enabled = true
+	d.config.NoCgroups = true
+	d.config.SingularityPath = filepath.Join(dir, "singularity")
+
+	fp := d.buildFingerprint()
+	if fp.Health != drivers.HealthStateUnhealthy {
+		t.Errorf("expected a missing binary to be unhealthy, got %s: %s", fp.Health, fp.HealthDescription)
+	}
+
+	fakeRuntime(t, dir, "apptainer version 1.1.0")
+	fp = d.buildFingerprint()
+	if fp.Health != drivers.HealthStateHealthy {
+		t.Fatalf("expected a healthy driver, got %s: %s", fp.Health, fp.HealthDescription)
+	}
+	for attr, want := range map[string]string{
+		"driver.singularity.version": "1.1.0",
+		"driver.singularity.flavor":  flavorApptainer,
+		"driver.singularity.setuid":  "false",
+	} {
+		if got, ok := fp.Attributes[attr]; !ok || got.GoString() != want {
+			t.Errorf("unexpected attribute %s = %v, want %s", attr, got, want)
+		}
+	}
+}
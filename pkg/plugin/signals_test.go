@@ -0,0 +1,38 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		signal  string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{"FullName", "SIGHUP", syscall.SIGHUP, false},
+		{"NoPrefix", "USR1", syscall.SIGUSR1, false},
+		{"LowerCase", "sigterm", syscall.SIGTERM, false},
+		{"Unknown", "SIGFOO", 0, true},
+		{"Empty", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSignal(tt.signal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSignal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSignal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
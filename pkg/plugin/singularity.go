@@ -7,33 +7,43 @@ package singularity
 
 import (
 	"fmt"
-	"io"
-	"os/exec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/sylabs/nomad-driver-singularity/pkg/executor"
 )
 
 const (
 	// defaultFailedCode for singularity runtime
 	defaultFailedCode = 255
+
+	// reattachPollInterval is the interval at which a reattached container
+	// process is checked for liveness
+	reattachPollInterval = time.Second
 )
 
 type syexec struct {
+	bin          string
 	argv         []string
-	cmd          *exec.Cmd
+	exec         *executor.Client
+	process      *os.Process
 	cachedir     string
 	taskConfig   TaskConfig
 	cfg          *drivers.TaskConfig
-	stdout       io.WriteCloser
-	stderr       io.WriteCloser
 	env          []string
+	secretEnv    []string
 	TaskDir      string
 	state        *psState
 	containerPid int
+	startTime    uint64
+	socketPath   string
+	cgroup       *taskCgroup
 	exitCode     int
 	ExitError    error
 	logger       hclog.Logger
@@ -49,60 +59,219 @@ type psState struct {
 func (s *syexec) startContainer(commandCfg *drivers.TaskConfig) error {
 	s.logger.Debug("launching command", strings.Join(s.argv, " "))
 
-	cmd := exec.Command(singularityBIN, s.argv...)
+	dir, err := ioutil.TempDir("", "singularity-executor")
+	if err != nil {
+		return fmt.Errorf("failed to create executor directory: %v", err)
+	}
+	s.socketPath = filepath.Join(dir, "executor.sock")
 
-	// set the writers for stdout and stderr
-	stdout, err := s.Stdout()
+	exec, err := executor.Launch(&executor.Config{
+		SocketPath: s.socketPath,
+		LogFile:    filepath.Join(commandCfg.TaskDir().Dir, "executor.out"),
+		LogLevel:   logLevel(s.logger),
+	})
 	if err != nil {
+		os.RemoveAll(dir)
 		return err
 	}
-	stderr, err := s.Stderr()
+
+	env := append(s.env, fmt.Sprintf("SINGULARITY_CACHEDIR=%s", s.cachedir))
+	env = append(env, s.secretEnv...)
+
+	req := &executor.LaunchRequest{
+		Cmd:        s.bin,
+		Args:       s.argv,
+		Env:        env,
+		Dir:        commandCfg.TaskDir().Dir,
+		StdoutPath: commandCfg.StdoutPath,
+		StderrPath: commandCfg.StderrPath,
+	}
+	if s.cgroup != nil {
+		req.Cgroups = s.cgroup.dirs()
+	}
+
+	pid, err := exec.Launch(req)
+	if err != nil {
+		exec.Destroy()
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to start singularity: %v", err)
+	}
+
+	s.exec = exec
+	s.containerPid = pid
+	// the start time tells the container process apart from a process
+	// recycling its pid once it is reaped
+	if st, err := readProcStat(pid); err == nil {
+		s.startTime = st.StartTime
+	}
+
+	return nil
+}
+
+// logLevel returns the name of the level of logger, which the executor logs
+// at
+func logLevel(logger hclog.Logger) string {
+	switch {
+	case logger.IsTrace():
+		return "trace"
+	case logger.IsDebug():
+		return "debug"
+	case logger.IsInfo():
+		return "info"
+	case logger.IsWarn():
+		return "warn"
+	}
+	return "error"
+}
+
+// reattachExecutor connects to the executor supervising the container
+func (s *syexec) reattachExecutor(socketPath string, pid int) error {
+	exec, err := executor.Reattach(socketPath)
 	if err != nil {
 		return err
 	}
 
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-
-	// set the task dir as the working directory for the command
-	cmd.Dir = commandCfg.TaskDir().Dir
-	cmd.Path = singularityBIN
-	cmd.Args = append([]string{cmd.Path}, s.argv...)
-	cmd.Env = append(s.env, fmt.Sprintf("SINGULARITY_CACHEDIR=%s", s.cachedir))
-
-	// Start the process
-	if err := cmd.Run(); err != nil {
-		// try to get the exit code
-		if exitError, ok := err.(*exec.ExitError); ok {
-			ws := exitError.Sys().(syscall.WaitStatus)
-			s.exitCode = ws.ExitStatus()
-		} else {
-			s.logger.Error("Could not get exit code for failed program: ", "singularity", s.argv)
-			s.exitCode = defaultFailedCode
-		}
-	} else {
-		// success, exitCode should be 0 if go is ok
-		ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
-		s.exitCode = ws.ExitStatus()
+	s.exec = exec
+	s.socketPath = socketPath
+	s.containerPid = pid
+	return nil
+}
+
+// reattach adopts an already running container process started before tasks
+// were supervised by an executor. The start time
+// recorded at launch is compared with the current one so that a recycled pid
+// is never mistaken for the container process. The command line is only
+// checked for presence, as the singularity starter rewrites its own.
+func (s *syexec) reattach(pid int, startTime uint64) error {
+	if pid <= 0 || startTime == 0 {
+		return fmt.Errorf("missing container process information")
+	}
+
+	st, err := readProcStat(pid)
+	if err != nil {
+		return fmt.Errorf("container process %d not found: %v", pid, err)
+	}
+	if st.StartTime != startTime {
+		return fmt.Errorf("process %d is not the container process, pid has been reused", pid)
+	}
+	if st.State == "Z" || st.State == "X" {
+		return fmt.Errorf("container process %d has exited", pid)
+	}
+	if argv, err := readProcCmdline(pid); err != nil || len(argv) == 0 {
+		return fmt.Errorf("container process %d has no command line", pid)
 	}
 
-	s.cmd = cmd
+	// FindProcess always succeeds on unix systems
+	proc, _ := os.FindProcess(pid)
 
-	s.state = &psState{Pid: s.cmd.Process.Pid, ExitCode: s.exitCode, Time: time.Now()}
+	s.process = proc
+	s.containerPid = pid
+	s.startTime = startTime
 	return nil
 }
 
-// waitTillStopped blocks and returns true when container exit;
-// returns false with an error message if the container processes cannot be identified.
-// func (s *syexec) waitTillStopped() (bool, error) {
-// 	ps, err := os.FindProcess(s.containerPid)
-// 	if err != nil {
-// 		return false, err
-// 	}
-
-// 	for {
-// 		if err := ps.Signal(syscall.Signal(0)); err != nil {
-// 			return true, nil
-// 		}
-// 	}
-// }
+// wait blocks until the container process exits and returns its final state.
+func (s *syexec) wait() *psState {
+	if s.exec == nil {
+		return s.waitReattached()
+	}
+
+	ps, err := s.exec.Wait()
+	if err != nil {
+		s.logger.Error("failed to wait on container process", "pid", s.containerPid, "error", err)
+		s.ExitError = fmt.Errorf("executor: error waiting on process: %v", err)
+		s.exitCode = defaultFailedCode
+		s.state = &psState{Pid: s.containerPid, ExitCode: defaultFailedCode, Time: time.Now()}
+		return s.state
+	}
+
+	s.exitCode = ps.ExitCode
+	s.state = &psState{Pid: ps.Pid, ExitCode: ps.ExitCode, Signal: ps.Signal, Time: ps.Time}
+	return s.state
+}
+
+// signal delivers sig to the container process. The singularity runtime
+// forwards it to the containerized application.
+func (s *syexec) signal(sig os.Signal) error {
+	if s.exec == nil {
+		return s.process.Signal(sig)
+	}
+	return s.exec.Signal(sig)
+}
+
+// signalGroup sends sig to the process group led by the container process
+func (s *syexec) signalGroup(sig syscall.Signal) error {
+	pgid, err := syscall.Getpgid(s.containerPid)
+	if err != nil {
+		return fmt.Errorf("failed to get process group of %d: %v", s.containerPid, err)
+	}
+
+	// COMPAT: containers started by older drivers share the process group
+	// of their parent, which must not be signaled
+	if pgid != s.containerPid {
+		return s.signal(sig)
+	}
+	return syscall.Kill(-pgid, sig)
+}
+
+// alive returns true while the pid of the container still refers to the
+// container process. The executor may have reaped the container already, in
+// which case its pid may belong to another process.
+func (s *syexec) alive() bool {
+	return s.startTime != 0 && isProcAlive(s.containerPid, s.startTime)
+}
+
+// kill sends SIGKILL to the container process group and to every process of
+// its tree, which may have moved to another group
+func (s *syexec) kill() error {
+	if !s.alive() {
+		return nil
+	}
+	if err := s.signalGroup(syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		s.logger.Warn("failed to kill container process group", "error", err)
+	}
+	return killProcessTree(s.containerPid)
+}
+
+// destroy terminates the executor, which closes the task outputs, and
+// removes the artifacts created for the container: the executor socket
+// directory and the task cgroup. The container must not be running anymore.
+func (s *syexec) destroy() error {
+	var err error
+	if s.exec != nil {
+		if err = s.exec.Destroy(); err != nil {
+			err = fmt.Errorf("failed to destroy executor: %v", err)
+		}
+	}
+
+	if s.socketPath != "" {
+		if rerr := os.RemoveAll(filepath.Dir(s.socketPath)); rerr != nil {
+			s.logger.Warn("failed to remove executor directory", "error", rerr)
+		}
+	}
+
+	if s.cgroup != nil {
+		if cerr := s.cgroup.destroy(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// waitReattached blocks until a reattached container process exits. The
+// process is not a child of the plugin so its exit status can't be collected.
+func (s *syexec) waitReattached() *psState {
+	ticker := time.NewTicker(reattachPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !isProcAlive(s.containerPid, s.startTime) {
+			break
+		}
+	}
+
+	s.ExitError = fmt.Errorf("reattached container process %d exited with unknown status", s.containerPid)
+	s.exitCode = defaultFailedCode
+	s.state = &psState{Pid: s.containerPid, ExitCode: defaultFailedCode, Time: time.Now()}
+	return s.state
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/nomad/client/stats"
+	shelpers "github.com/hashicorp/nomad/helper/stats"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// clockTicks is the number of clock ticks per second (USER_HZ) in which
+	// /proc reports cpu times, it is 100 on all supported architectures
+	clockTicks = 100
+)
+
+var (
+	// measuredMemStats is the list of memory stats sampled from /proc
+	measuredMemStats = []string{"RSS", "Swap"}
+
+	// measuredCPUStats is the list of cpu stats sampled from /proc
+	measuredCPUStats = []string{"System Mode", "User Mode", "Percent"}
+)
+
+// pidCPUStats holds the cpu percentage calculators of a pid
+type pidCPUStats struct {
+	total *stats.CpuStats
+	user  *stats.CpuStats
+	sys   *stats.CpuStats
+}
+
+// statsCollector samples the resource usage of the process tree of a task.
+// The tree is only sampled while pid is the container process started at
+// startTime, not a process recycling its pid.
+type statsCollector struct {
+	pid       int
+	startTime uint64
+	cgroup    *taskCgroup
+	pids      map[int]*pidCPUStats
+	systemCPU *stats.CpuStats
+}
+
+func newStatsCollector(pid int, startTime uint64, cgroup *taskCgroup) *statsCollector {
+	// required to compute the ticks consumed, failures leave it to 0
+	shelpers.Init()
+
+	return &statsCollector{
+		pid:       pid,
+		startTime: startTime,
+		cgroup:    cgroup,
+		pids:      make(map[int]*pidCPUStats),
+		systemCPU: stats.NewCpuStats(),
+	}
+}
+
+// collect returns the current resource usage of the process tree
+func (c *statsCollector) collect() (*drivers.TaskResourceUsage, error) {
+	if !isProcAlive(c.pid, c.startTime) {
+		return nil, fmt.Errorf("container process %d exited", c.pid)
+	}
+	tree, err := processTree(c.pid)
+	if err != nil {
+		return nil, err
+	}
+
+	pidStats := make(map[string]*drivers.ResourceUsage, len(tree))
+	seen := make(map[int]struct{}, len(tree))
+	for _, pid := range tree {
+		st, err := readProcStat(pid)
+		if err != nil {
+			// the process exited since the tree was built
+			continue
+		}
+		seen[pid] = struct{}{}
+
+		cpu, ok := c.pids[pid]
+		if !ok {
+			cpu = &pidCPUStats{
+				total: stats.NewCpuStats(),
+				user:  stats.NewCpuStats(),
+				sys:   stats.NewCpuStats(),
+			}
+			c.pids[pid] = cpu
+		}
+
+		ms := &drivers.MemoryStats{
+			RSS:      st.RSS,
+			Measured: measuredMemStats,
+		}
+		if swap, err := readProcSwap(pid); err == nil {
+			ms.Swap = swap
+		}
+
+		user := float64(st.UTime) / clockTicks * float64(time.Second)
+		sys := float64(st.STime) / clockTicks * float64(time.Second)
+		cs := &drivers.CpuStats{
+			UserMode:   cpu.user.Percent(user),
+			SystemMode: cpu.sys.Percent(sys),
+			Percent:    cpu.total.Percent(user + sys),
+			Measured:   measuredCPUStats,
+		}
+
+		pidStats[strconv.Itoa(pid)] = &drivers.ResourceUsage{
+			MemoryStats: ms,
+			CpuStats:    cs,
+		}
+	}
+
+	// forget about processes which exited
+	for pid := range c.pids {
+		if _, ok := seen[pid]; !ok {
+			delete(c.pids, pid)
+		}
+	}
+
+	return c.aggregate(pidStats), nil
+}
+
+// mergeMeasured returns the union of two lists of measured stats
+func mergeMeasured(a, b []string) []string {
+	merged := make([]string, 0, len(a)+len(b))
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for _, m := range append(append([]string{}, a...), b...) {
+		if _, ok := seen[m]; !ok {
+			seen[m] = struct{}{}
+			merged = append(merged, m)
+		}
+	}
+	return merged
+}
+
+// aggregate sums the resource usage of all pids into a TaskResourceUsage
+func (c *statsCollector) aggregate(pidStats map[string]*drivers.ResourceUsage) *drivers.TaskResourceUsage {
+	ms := &drivers.MemoryStats{Measured: measuredMemStats}
+	cs := &drivers.CpuStats{Measured: measuredCPUStats}
+
+	for _, ru := range pidStats {
+		ms.RSS += ru.MemoryStats.RSS
+		ms.Swap += ru.MemoryStats.Swap
+		cs.UserMode += ru.CpuStats.UserMode
+		cs.SystemMode += ru.CpuStats.SystemMode
+		cs.Percent += ru.CpuStats.Percent
+	}
+	cs.TotalTicks = c.systemCPU.TicksConsumed(cs.Percent)
+
+	// the cgroup accounts for memory and cpu usage /proc can't report
+	if c.cgroup != nil {
+		cgMem, cgCPU, err := c.cgroup.stats()
+		if err == nil {
+			ms.Cache = cgMem.Cache
+			ms.Usage = cgMem.Usage
+			ms.MaxUsage = cgMem.MaxUsage
+			ms.KernelUsage = cgMem.KernelUsage
+			ms.KernelMaxUsage = cgMem.KernelMaxUsage
+			if cgMem.Swap > ms.Swap {
+				ms.Swap = cgMem.Swap
+			}
+			ms.Measured = mergeMeasured(ms.Measured, cgMem.Measured)
+
+			cs.ThrottledPeriods = cgCPU.ThrottledPeriods
+			cs.ThrottledTime = cgCPU.ThrottledTime
+			cs.Measured = mergeMeasured(cs.Measured, cgCPU.Measured)
+		}
+	}
+
+	return &drivers.TaskResourceUsage{
+		ResourceUsage: &drivers.ResourceUsage{
+			MemoryStats: ms,
+			CpuStats:    cs,
+		},
+		Timestamp: time.Now().UTC().UnixNano(),
+		Pids:      pidStats,
+	}
+}
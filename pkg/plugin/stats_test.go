@@ -0,0 +1,45 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestStatsCollector(t *testing.T) {
+	st, err := readProcStat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newStatsCollector(os.Getpid(), st.StartTime, nil)
+
+	usage, err := c.collect()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ru, ok := usage.Pids[strconv.Itoa(os.Getpid())]
+	if !ok {
+		t.Fatalf("current process missing from pid stats")
+	}
+	if ru.MemoryStats.RSS == 0 {
+		t.Errorf("expected a non zero RSS")
+	}
+	if usage.ResourceUsage.MemoryStats.RSS < ru.MemoryStats.RSS {
+		t.Errorf("aggregated RSS %d lower than process RSS %d", usage.ResourceUsage.MemoryStats.RSS, ru.MemoryStats.RSS)
+	}
+	if usage.Timestamp == 0 {
+		t.Errorf("expected a timestamp")
+	}
+
+	// a process recycling the pid of the container is not sampled
+	c = newStatsCollector(os.Getpid(), st.StartTime+1, nil)
+	if _, err := c.collect(); err == nil {
+		t.Errorf("expected stats of a recycled pid to fail")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// verifyOff, verifyWarn and verifyEnforce are the verification policies
+	// of images: not verified, started with a warning when the verification
+	// fails, or refused
+	verifyOff     = "off"
+	verifyWarn    = "warn"
+	verifyEnforce = "enforce"
+
+	// imageVerifyTimeout bounds the verification of an image, which hashes
+	// its whole content
+	imageVerifyTimeout = 5 * time.Minute
+)
+
+// verifyLevels orders the verification policies by strictness
+var verifyLevels = map[string]int{
+	verifyOff:     0,
+	verifyWarn:    1,
+	verifyEnforce: 2,
+}
+
+// verifyResult is the output of singularity verify --json
+type verifyResult struct {
+	Signatures int `json:"Signatures"`
+	SignerKeys []struct {
+		Signer struct {
+			Partition   string `json:"Partition"`
+			DataCheck   bool   `json:"DataCheck"`
+			Fingerprint string `json:"Fingerprint"`
+		} `json:"Signer"`
+	} `json:"SignerKeys"`
+}
+
+// validateVerifyPolicy returns an error if policy is not a known policy
+func validateVerifyPolicy(policy string) error {
+	if _, ok := verifyLevels[policy]; !ok {
+		return fmt.Errorf("invalid verify policy %q, expected one of %s, %s or %s", policy, verifyOff, verifyWarn, verifyEnforce)
+	}
+	return nil
+}
+
+// normalizeFingerprint formats a key fingerprint for comparisons
+func normalizeFingerprint(fp string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(fp), ""))
+}
+
+// verifyPolicy returns the verification policy of the image of the task cfg.
+// Tasks may only relax the policy of the plugin if allow_verify_override is
+// set.
+func (d *Driver) verifyPolicy(cfg TaskConfig) (string, error) {
+	policy := d.config.Verify
+	if policy == "" {
+		policy = verifyOff
+	}
+	if cfg.Verify == "" {
+		return policy, nil
+	}
+
+	if err := validateVerifyPolicy(cfg.Verify); err != nil {
+		return "", err
+	}
+	if !d.config.AllowVerifyOverride && verifyLevels[cfg.Verify] < verifyLevels[policy] {
+		return "", fmt.Errorf("verify policy %q of the task is weaker than the %q policy of the plugin", cfg.Verify, policy)
+	}
+	return cfg.Verify, nil
+}
+
+// verifyImage checks the signatures of the local SIF image and returns the
+// fingerprints of the keys which signed it. Relative images are found from
+// dir, the task directory singularity runs them from.
+func (d *Driver) verifyImage(ctx context.Context, bin, dir, image string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, imageVerifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, bin, "verify", "--local", "--json", image)
+	cmd.Dir = dir
+	if d.config.VerifyKeyring != "" {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SINGULARITY_SYPGPDIR=%s", d.config.VerifyKeyring))
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		msg := err.Error()
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) != 0 {
+			msg = strings.TrimSpace(string(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("signature verification failed: %s", msg)
+	}
+
+	var result verifyResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse verification output: %v", err)
+	}
+	var signers []string
+	for _, k := range result.SignerKeys {
+		if k.Signer.DataCheck && k.Signer.Fingerprint != "" {
+			signers = append(signers, normalizeFingerprint(k.Signer.Fingerprint))
+		}
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("image is not signed")
+	}
+	return signers, nil
+}
+
+// checkSigners returns an error unless one of signers is a trusted key, any
+// key of the keyring being trusted when no trusted_keys are set
+func (d *Driver) checkSigners(signers []string) error {
+	if len(d.config.TrustedKeys) == 0 {
+		return nil
+	}
+	for _, trusted := range d.config.TrustedKeys {
+		for _, signer := range signers {
+			if normalizeFingerprint(trusted) == signer {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("image is signed by untrusted keys %s", strings.Join(signers, ", "))
+}
+
+// verifyTaskImage applies policy to image, the local copy of the image uri of
+// the task cfg. A task image failing verification emits a task event, and is
+// refused with a non recoverable error under the enforce policy.
+func (d *Driver) verifyTaskImage(cfg *drivers.TaskConfig, bin, uri, image, policy string) error {
+	if policy == verifyOff {
+		return nil
+	}
+
+	var err error
+	if scheme := imageScheme(image); scheme != "" {
+		err = fmt.Errorf("%s images can't be verified", scheme)
+	} else {
+		var signers []string
+		signers, err = d.verifyImage(d.ctx, bin, cfg.TaskDir().Dir, image)
+		if err == nil {
+			err = d.checkSigners(signers)
+		}
+	}
+	if err == nil {
+		d.logger.Debug("image verified", "image", uri)
+		return nil
+	}
+
+	d.emitEvent(cfg, "Image verification failed", map[string]string{
+		"image":  uri,
+		"policy": policy,
+		"error":  err.Error(),
+	})
+	if policy == verifyWarn {
+		d.logger.Warn("image verification failed, starting task anyway", "image", uri, "error", err)
+		return nil
+	}
+	return structs.NewRecoverableError(fmt.Errorf("image %s failed verification: %v", uri, err), false)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package singularity
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// verifyingRuntime writes a runtime which reports the images whose content
+// is "signed <fingerprint>" as signed by that key
+func verifyingRuntime(t *testing.T, dir string) string {
+	script := `#!/bin/sh
+[ "$1" = verify ] || exit 1
+read content fp < "$4"
+if [ "$content" != signed ]; then
+	echo "FATAL: no signatures found for system partition" >&2
+	exit 255
+fi
+echo '{"Signatures":1,"SignerKeys":[{"Signer":{"Partition":"Def.FILE","DataCheck":true,"Fingerprint":"'$fp'"}}]}'
+`
+	bin := filepath.Join(dir, "singularity")
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake runtime: %v", err)
+	}
+	return bin
+}
+
+func TestDriver_VerifyPolicy(t *testing.T) {
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	if policy, err := d.verifyPolicy(TaskConfig{}); err != nil || policy != verifyOff {
+		t.Errorf("unexpected default policy %q: %v", policy, err)
+	}
+
+	d.config.Verify = verifyWarn
+	for _, tc := range []struct {
+		override bool
+		task     string
+		want     string
+		err      bool
+	}{
+		{false, "", verifyWarn, false},
+		{false, verifyEnforce, verifyEnforce, false},
+		{false, verifyOff, "", true},
+		{true, verifyOff, verifyOff, false},
+		{true, "sometimes", "", true},
+	} {
+		d.config.AllowVerifyOverride = tc.override
+		policy, err := d.verifyPolicy(TaskConfig{Verify: tc.task})
+		if tc.err != (err != nil) || policy != tc.want {
+			t.Errorf("override=%v task=%q: unexpected policy %q: %v", tc.override, tc.task, policy, err)
+		}
+	}
+}
+
+func TestDriver_VerifyTaskImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := verifyingRuntime(t, dir)
+
+	images := map[string]string{
+		"trusted":   "signed 1234 ABCD",
+		"untrusted": "signed FFFF0000",
+		"unsigned":  "unsigned",
+	}
+	for name, content := range images {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".sif"), []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a relative image is found in the task directory
+	cfg := &drivers.TaskConfig{ID: "task", Name: "mooo", AllocID: "alloc", AllocDir: dir}
+	local := filepath.Join(cfg.TaskDir().Dir, "local")
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, "app.sif"), []byte(images["trusted"]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewSingularityDriver(hclog.NewNullLogger()).(*Driver)
+	d.config.TrustedKeys = []string{"1234abcd"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	taskEvents, err := d.TaskEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan *drivers.TaskEvent, 10)
+	go func() {
+		for ev := range taskEvents {
+			events <- ev
+		}
+	}()
+
+	for _, tc := range []struct {
+		image  string
+		policy string
+		err    string
+	}{
+		{"trusted", verifyEnforce, ""},
+		{"untrusted", verifyEnforce, "untrusted keys FFFF0000"},
+		{"unsigned", verifyEnforce, "no signatures found"},
+		{"unsigned", verifyWarn, ""},
+		{"unsigned", verifyOff, ""},
+		{"local/app.sif", verifyEnforce, ""},
+	} {
+		image := tc.image
+		if !strings.Contains(image, "/") {
+			image = filepath.Join(dir, tc.image+".sif")
+		}
+		err := d.verifyTaskImage(cfg, bin, image, image, tc.policy)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s/%s: unexpected error: %v", tc.image, tc.policy, err)
+		}
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s/%s: expected error %q, got %v", tc.image, tc.policy, tc.err, err)
+			} else if structs.IsRecoverable(err) {
+				t.Errorf("%s/%s: expected non recoverable error", tc.image, tc.policy)
+			}
+		}
+
+		if tc.err == "" && tc.policy != verifyWarn {
+			continue
+		}
+		select {
+		case ev := <-events:
+			if ev.Message != "Image verification failed" || ev.Annotations["policy"] != tc.policy {
+				t.Errorf("unexpected event %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s/%s: timeout waiting for verification event", tc.image, tc.policy)
+		}
+	}
+}